@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// the slots of the counters map, the values have to match the COUNT_* defines in firewall.c
+const (
+	countRangeAccept = iota
+	countRangeDrop
+	countCIDRAllow
+	countCIDRDeny
+	countUnfiltered
+	countMalformed
+	countSlots
+)
+
+var countNames = [countSlots]string{
+	countRangeAccept: "ip range accepted",
+	countRangeDrop:   "ip range dropped",
+	countCIDRAllow:   "cidr list allowed",
+	countCIDRDeny:    "cidr list denied",
+	countUnfiltered:  "not filtered",
+	countMalformed:   "malformed dropped",
+}
+
+// the layout has to match struct counter in firewall.c
+type counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// add up the per cpu copies of every slot
+func readCounters(m *ebpf.Map) ([countSlots]counter, error) {
+	var totals [countSlots]counter
+	for slot := range totals {
+		var perCPU []counter
+		if err := m.Lookup(uint32(slot), &perCPU); err != nil {
+			return totals, fmt.Errorf("reading counter %d: %w", slot, err)
+		}
+		for _, c := range perCPU {
+			totals[slot].Packets += c.Packets
+			totals[slot].Bytes += c.Bytes
+		}
+	}
+	return totals, nil
+}
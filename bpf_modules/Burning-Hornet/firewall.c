@@ -13,6 +13,10 @@
 #include <netinet/in.h>
 // add struct tcphdr
 #include <linux/tcp.h>
+// add struct ipv6hdr
+#include <linux/ipv6.h>
+// add bpf_htons()
+#include <bpf/bpf_endian.h>
 
 /*=============================================*/
 /*              *map config*                   */
@@ -22,7 +26,7 @@
 /* 2. entry = lower ip boundary (source)       */
 /* 3. entry = upper ip boundary (source)       */
 /* 4. entry = setting for firewall behaviour   */
-/* 5. entry = number of received packets       */
+/* 5. entry = unused, see counters below       */
 /*=============================================*/
 struct
 {
@@ -36,6 +40,108 @@ struct
     __uint(max_entries, 5);
 } Map SEC(".maps");
 
+/*=============================================*/
+/*            *cidr list config*               */
+/* allow and deny lists of source networks,    */
+/* checked before the ip range of Map          */
+/* IPv4 networks are IPv4-mapped (::ffff:a.b.c.d) */
+/* bpf_modules/cidr_lists mirrors the layout   */
+/*=============================================*/
+#define MAX_CIDR_RULES 16384
+#define CIDR_ACTION_ALLOW 1
+#define CIDR_ACTION_DENY 2
+
+struct cidr_key
+{
+    // prefix length in bits, 128 on lookups (the first member of every LPM_TRIE key)
+    __u32 prefixlen;
+    __u8 addr[16];
+};
+
+struct cidr_rule
+{
+    // CIDR_ACTION_*
+    __u32 action;
+    // already resolved by cidr_lists, the longest matching prefix carries the winning action
+    __u32 priority;
+};
+
+struct cidr_trie
+{
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __type(key, struct cidr_key);
+    __type(value, struct cidr_rule);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __uint(max_entries, MAX_CIDR_RULES);
+};
+
+// index 0 holds the trie in use, main.go swaps in a new one on every reload
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+    __type(key, __u32);
+    __uint(max_entries, 1);
+    __array(values, struct cidr_trie);
+} cidr_lists SEC(".maps");
+
+// return the action of the cidr lists for a source address, 0 if nothing matches
+static __always_inline __u32 match_cidr_lists(struct cidr_key *key)
+{
+    __u32 zero = 0;
+    void *trie = bpf_map_lookup_elem(&cidr_lists, &zero);
+    if (!trie)
+    {
+        return 0;
+    }
+
+    struct cidr_rule *rule = bpf_map_lookup_elem(trie, key);
+    if (!rule)
+    {
+        return 0;
+    }
+    return rule->action;
+}
+
+/*=============================================*/
+/*              *counter config*               */
+/* type = per cpu array, one slot per reason   */
+/* every cpu counts into its own copy, so no   */
+/* packet gets lost between cpus, main.go adds */
+/* the copies up                               */
+/*=============================================*/
+#define COUNT_RANGE_ACCEPT 0 // source inside the ip range
+#define COUNT_RANGE_DROP 1   // source outside the ip range
+#define COUNT_CIDR_ALLOW 2   // allowed by the cidr lists
+#define COUNT_CIDR_DENY 3    // denied by the cidr lists
+#define COUNT_UNFILTERED 4   // no ip range configured, or IPv6 not on the lists
+#define COUNT_MALFORMED 5    // truncated headers
+#define COUNT_SLOTS 6
+
+struct counter
+{
+    __u64 packets;
+    __u64 bytes;
+};
+
+struct
+{
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, struct counter);
+    __uint(max_entries, COUNT_SLOTS);
+} counters SEC(".maps");
+
+// count a packet into its slot on this cpu
+static __always_inline void count(struct xdp_md *ctx, __u32 slot)
+{
+    struct counter *c = bpf_map_lookup_elem(&counters, &slot);
+    if (c)
+    {
+        c->packets++;
+        c->bytes += ctx->data_end - ctx->data;
+    }
+}
+
 SEC("xdp_prog")
 // member variables of the xdp_md struct are assigned by the NIC driver
 int xdp_filter_ip_range(struct xdp_md *ctx)
@@ -58,13 +164,41 @@ int xdp_filter_ip_range(struct xdp_md *ctx)
     // e.g. if 0x0006 + 8 > 0x0009, then drop
     if ((void *)eth + sizeof(*eth) > data_end)
     {
+        count(ctx, COUNT_MALFORMED);
         return XDP_DROP;
     }
 
+    struct cidr_key cidr = {.prefixlen = 128};
+
+    // the ip range only knows IPv4, IPv6 packets are only checked against the cidr lists
+    if (eth->h_proto == bpf_htons(ETH_P_IPV6))
+    {
+        struct ipv6hdr *ip6 = data + sizeof(struct ethhdr);
+        if ((void *)ip6 + sizeof(*ip6) > data_end)
+        {
+            count(ctx, COUNT_MALFORMED);
+            return XDP_DROP;
+        }
+        __builtin_memcpy(cidr.addr, &ip6->saddr, sizeof(cidr.addr));
+        switch (match_cidr_lists(&cidr))
+        {
+        case CIDR_ACTION_DENY:
+            count(ctx, COUNT_CIDR_DENY);
+            return XDP_DROP;
+        case CIDR_ACTION_ALLOW:
+            count(ctx, COUNT_CIDR_ALLOW);
+            return XDP_PASS;
+        default:
+            count(ctx, COUNT_UNFILTERED);
+            return XDP_PASS;
+        }
+    }
+
     // ip block starts after the eth block
     struct iphdr *ip = data + sizeof(struct ethhdr);
     if ((void *)ip + sizeof(*ip) > data_end)
     {
+        count(ctx, COUNT_MALFORMED);
         return XDP_DROP;
     }
     __u32 src_ip = ip->saddr;
@@ -74,6 +208,25 @@ int xdp_filter_ip_range(struct xdp_md *ctx)
     __be16 src_port = tcp->source;
     __be16 dst_port = tcp->dest;
 
+    // an address on the cidr lists is decided right away, the ip range only sees the rest
+    if (eth->h_proto == bpf_htons(ETH_P_IP))
+    {
+        cidr.addr[10] = 0xff;
+        cidr.addr[11] = 0xff;
+        __builtin_memcpy(&cidr.addr[12], &ip->saddr, 4);
+        switch (match_cidr_lists(&cidr))
+        {
+        case CIDR_ACTION_DENY:
+            count(ctx, COUNT_CIDR_DENY);
+            return XDP_DROP;
+        case CIDR_ACTION_ALLOW:
+            count(ctx, COUNT_CIDR_ALLOW);
+            return XDP_PASS;
+        default:
+            break;
+        }
+    }
+
     // retrieve lower ip boundary from map
     key = 1;
     value = bpf_map_lookup_elem(&Map, &key);
@@ -117,20 +270,12 @@ int xdp_filter_ip_range(struct xdp_md *ctx)
             }
 
             // count accepted packets
-            key = 4;
-            value = bpf_map_lookup_elem(&Map, &key);
-            if (value)
-            {
-                *value = *value + 1;
-            }
-            if (value)
-            {
-                bpf_map_update_elem(&Map, &key, value, BPF_ANY);
-            }
+            count(ctx, COUNT_RANGE_ACCEPT);
             return XDP_PASS;
         }
         else
         {
+            count(ctx, COUNT_RANGE_DROP);
             return XDP_DROP;
         }
         break;
@@ -138,6 +283,7 @@ int xdp_filter_ip_range(struct xdp_md *ctx)
         break;
     }
 
+    count(ctx, COUNT_UNFILTERED);
     return XDP_PASS;
 }
 
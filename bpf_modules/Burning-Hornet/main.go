@@ -1,17 +1,27 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	"cidr_lists"
+
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
 )
 
+// default cidr list, relative to the working directory (john_wick)
+const cidrListsPath = "firewall_system_cidrs.list"
+
 func main() {
+	cidrFiles := flag.String("cidr-lists", cidrListsPath, "comma separated files with allow and deny lists of source addresses")
+	flag.Parse()
+
 	// Remove resource limits for kernels <5.11.
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatal("Removing memlock:", err)
@@ -54,6 +64,10 @@ func main() {
 	}
 	defer link.Close()
 
+	// allow and deny lists of source networks, reloaded when a file changes
+	lists := cidr_lists.New(objs.CidrLists, strings.Split(*cidrFiles, ","))
+	lists.ReloadIfChanged()
+
 	log.Printf("<<<<--------------------------------------------------------->>>>")
 	log.Printf("	              Welcome to Furkan's Firewall!")
 	log.Printf("	Enjoy your stay and listen on the network interface %s!", ifname)
@@ -67,6 +81,7 @@ func main() {
 	for {
 		select {
 		case <-tick:
+			lists.ReloadIfChanged()
 
 			var ip_source_addres uint64
 			var lower_ip_boundary uint64
@@ -94,10 +109,12 @@ func main() {
 				log.Fatal("Map lookup:", err)
 			}
 
-			err = objs.Map.Lookup(uint32(4), &crazy_counter)
+			// per cpu counters, the old counter in slot 4 lost packets counted at the same time on different cpus
+			counters, err := readCounters(objs.Counters)
 			if err != nil {
 				log.Fatal("Map lookup:", err)
 			}
+			crazy_counter = counters[countRangeAccept].Packets
 
 			if config_number == 1 {
 				lower_ip := convert_little_to_big(lower_ip_boundary)
@@ -117,6 +134,11 @@ func main() {
 				log.Printf("    waiting for configuration...")
 			}
 
+			// the cidr lists work without a configured ip range
+			for slot, c := range counters {
+				log.Printf("    %-18s %d packets, %d bytes", countNames[slot]+":", c.Packets, c.Bytes)
+			}
+
 		case <-stop:
 			log.Print("Received signal, exiting...")
 			return
@@ -0,0 +1,274 @@
+package cidr_lists
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * The allow and deny lists of addresses of both firewalls (firewall_container and Burning-Hornet),
+ * loaded into the trie their bpf programs look addresses up in.
+ */
+
+/*
+ * the values have to match the defines and struct cidr_trie in firewall_container.c
+ * (RULE_ACTION_*) and Burning-Hornet/firewall.c (CIDR_ACTION_*)
+ */
+const (
+	MaxRules = 16384
+
+	ActionAllow uint8 = 1
+	ActionDeny  uint8 = 2
+)
+
+var actionNames = map[string]uint8{
+	"allow": ActionAllow,
+	"deny":  ActionDeny,
+}
+
+/*
+ * key and value of the cidr list trie
+ * the layout has to match struct cidr_key and struct cidr_rule in both bpf programs
+ */
+type Key struct {
+	PrefixLen uint32
+	Addr      [16]byte
+}
+
+type Rule struct {
+	Action   uint32
+	Priority uint32
+}
+
+// a line of a cidr list
+type Entry struct {
+	// always 128 bit, IPv4 networks are IPv4-mapped
+	Prefix   netip.Prefix
+	Action   uint8
+	Priority uint32
+}
+
+/*
+ * parse an address or a network into a 128 bit prefix
+ * IPv4 is IPv4-mapped, like the addresses the bpf programs look up
+ */
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	var prefix netip.Prefix
+	var err error
+	if strings.Contains(cidr, "/") {
+		prefix, err = netip.ParsePrefix(cidr)
+	} else {
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(cidr); err == nil {
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q", cidr)
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), bits), nil
+}
+
+/*
+ * Parse a cidr list, one entry per line:
+ *   <allow|deny> <address or network> [priority]
+ * Empty lines and lines starting with # are ignored, the priority defaults to 0.
+ */
+func ParseList(file string) ([]Entry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<allow|deny> <cidr> [priority]\"", file, line)
+		}
+
+		var entry Entry
+		var ok bool
+		if entry.Action, ok = actionNames[fields[0]]; !ok {
+			return nil, fmt.Errorf("%s:%d: unknown action %q", file, line, fields[0])
+		}
+		if entry.Prefix, err = ParsePrefix(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		if len(fields) == 3 {
+			priority, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid priority %q", file, line, fields[2])
+			}
+			entry.Priority = uint32(priority)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	return entries, nil
+}
+
+// whether a wins over b: higher priority, then the longer prefix, then deny
+func (a Entry) beats(b Entry) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.Prefix.Bits() != b.Prefix.Bits() {
+		return a.Prefix.Bits() > b.Prefix.Bits()
+	}
+	return a.Action == ActionDeny && b.Action != ActionDeny
+}
+
+/*
+ * Turn the entries into the content of the trie.
+ * The trie only returns the longest matching prefix, so every prefix gets the action of the
+ * entry that wins among all entries covering it. Every entry covering an address also covers
+ * the longest prefix that matches it, so the lookup returns the same as checking every entry.
+ */
+func Compile(entries []Entry) map[Key]Rule {
+	// the winner for each distinct prefix
+	byPrefix := make(map[netip.Prefix]Entry, len(entries))
+	for _, e := range entries {
+		if cur, ok := byPrefix[e.Prefix]; !ok || e.beats(cur) {
+			byPrefix[e.Prefix] = e
+		}
+	}
+
+	rules := make(map[Key]Rule, len(byPrefix))
+	for prefix, own := range byPrefix {
+		best := own
+		for bits := 0; bits < prefix.Bits(); bits++ {
+			outer, _ := prefix.Addr().Prefix(bits)
+			if e, ok := byPrefix[outer]; ok && e.beats(best) {
+				best = e
+			}
+		}
+		key := Key{PrefixLen: uint32(prefix.Bits()), Addr: prefix.Addr().As16()}
+		rules[key] = Rule{Action: uint32(best.Action), Priority: best.Priority}
+	}
+	return rules
+}
+
+/*
+ * The cidr lists of the firewall. The files are read again when one of them changes, into a
+ * new trie that replaces the old one at once. If a file is broken, the old lists stay in place.
+ */
+type Lists struct {
+	files []string
+	outer *ebpf.Map
+	// modification times of the last load, a missing file is the zero time
+	modTimes map[string]time.Time
+	loaded   bool
+}
+
+func New(outer *ebpf.Map, files []string) *Lists {
+	return &Lists{files: files, outer: outer, modTimes: make(map[string]time.Time)}
+}
+
+// whether a file was changed, created or removed since the last load
+func (c *Lists) changed() bool {
+	if !c.loaded {
+		return true
+	}
+	for _, file := range c.files {
+		var mod time.Time
+		if info, err := os.Stat(file); err == nil {
+			mod = info.ModTime()
+		}
+		if !mod.Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Lists) ReloadIfChanged() {
+	if !c.changed() {
+		return
+	}
+
+	var entries []Entry
+	modTimes := make(map[string]time.Time, len(c.files))
+	for _, file := range c.files {
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			// no list is an empty list
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not read cidr list %s: %v", file, err)
+			return
+		}
+		list, err := ParseList(file)
+		if err != nil {
+			log.Printf("Keeping the loaded cidr lists: %v", err)
+			return
+		}
+		entries = append(entries, list...)
+		modTimes[file] = info.ModTime()
+	}
+
+	rules := Compile(entries)
+	if len(rules) > MaxRules {
+		log.Printf("Keeping the loaded cidr lists: %d prefixes, at most %d are supported", len(rules), MaxRules)
+		return
+	}
+	if err := c.swap(rules); err != nil {
+		log.Printf("Failed to load cidr lists: %v", err)
+		return
+	}
+	c.modTimes = modTimes
+	c.loaded = true
+	log.Printf("Loaded %d cidr list prefixes from %s", len(rules), strings.Join(c.files, ", "))
+}
+
+// fill a new trie and put it in place of the current one
+func (c *Lists) swap(rules map[Key]Rule) error {
+	trie, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "cidr_trie",
+		Type:       ebpf.LPMTrie,
+		KeySize:    uint32(binary.Size(Key{})),
+		ValueSize:  uint32(binary.Size(Rule{})),
+		MaxEntries: MaxRules,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	if err != nil {
+		return fmt.Errorf("creating trie: %w", err)
+	}
+	// the outer map holds its own reference
+	defer trie.Close()
+
+	for key, rule := range rules {
+		if err := trie.Update(key, rule, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("writing %s/%d: %w", netip.AddrFrom16(key.Addr), key.PrefixLen, err)
+		}
+	}
+
+	if err := c.outer.Update(uint32(0), trie, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("replacing trie: %w", err)
+	}
+	return nil
+}
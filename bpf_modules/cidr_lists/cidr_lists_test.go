@@ -0,0 +1,111 @@
+package cidr_lists
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	entry := func(action uint8, cidr string, priority uint32) Entry {
+		prefix, err := ParsePrefix(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Entry{Prefix: prefix, Action: action, Priority: priority}
+	}
+	key := func(cidr string) Key {
+		prefix, err := ParsePrefix(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Key{PrefixLen: uint32(prefix.Bits()), Addr: prefix.Addr().As16()}
+	}
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		want    map[Key]Rule
+	}{
+		{
+			name:    "empty",
+			entries: nil,
+			want:    map[Key]Rule{},
+		},
+		{
+			name:    "IPv4 host is IPv4-mapped",
+			entries: []Entry{entry(ActionDeny, "10.0.0.1", 0)},
+			want: map[Key]Rule{
+				{PrefixLen: 128, Addr: [16]byte{10: 0xff, 11: 0xff, 12: 10, 15: 1}}: {Action: uint32(ActionDeny)},
+			},
+		},
+		{
+			name:    "host bits are masked",
+			entries: []Entry{entry(ActionAllow, "192.168.1.7/24", 0)},
+			want: map[Key]Rule{
+				{PrefixLen: 120, Addr: [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 168, 14: 1}}: {Action: uint32(ActionAllow)},
+			},
+		},
+		{
+			name:    "IPv6 network",
+			entries: []Entry{entry(ActionDeny, "2001:db8::/32", 3)},
+			want: map[Key]Rule{
+				{PrefixLen: 32, Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8}}: {Action: uint32(ActionDeny), Priority: 3},
+			},
+		},
+		{
+			name: "longer prefix wins at the same priority",
+			entries: []Entry{
+				entry(ActionAllow, "10.0.0.0/8", 0),
+				entry(ActionDeny, "10.1.0.0/16", 0),
+			},
+			want: map[Key]Rule{
+				key("10.0.0.0/8"):  {Action: uint32(ActionAllow)},
+				key("10.1.0.0/16"): {Action: uint32(ActionDeny)},
+			},
+		},
+		{
+			name: "higher priority of an outer network reaches the inner ones",
+			entries: []Entry{
+				entry(ActionAllow, "10.0.0.0/8", 10),
+				entry(ActionDeny, "10.1.0.0/16", 1),
+				entry(ActionDeny, "10.1.2.3", 20),
+			},
+			want: map[Key]Rule{
+				key("10.0.0.0/8"):  {Action: uint32(ActionAllow), Priority: 10},
+				key("10.1.0.0/16"): {Action: uint32(ActionAllow), Priority: 10},
+				key("10.1.2.3"):    {Action: uint32(ActionDeny), Priority: 20},
+			},
+		},
+		{
+			name: "deny wins a tie",
+			entries: []Entry{
+				entry(ActionAllow, "10.0.0.0/8", 5),
+				entry(ActionDeny, "10.0.0.0/8", 5),
+				entry(ActionAllow, "10.0.0.0/8", 5),
+			},
+			want: map[Key]Rule{
+				key("10.0.0.0/8"): {Action: uint32(ActionDeny), Priority: 5},
+			},
+		},
+		{
+			name: "::/0 also covers IPv4, it is IPv4-mapped",
+			entries: []Entry{
+				entry(ActionDeny, "::/0", 10),
+				entry(ActionAllow, "10.0.0.0/8", 0),
+			},
+			want: map[Key]Rule{
+				key("::/0"):       {Action: uint32(ActionDeny), Priority: 10},
+				key("10.0.0.0/8"): {Action: uint32(ActionDeny), Priority: 10},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Compile(tt.entries)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Compile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// pinned by the bpf program (LIBBPF_PIN_BY_NAME), so the CLI can read it while the firewall runs
+const conntrackMapPath = "/sys/fs/bpf/maps/map_conntrack"
+
+// states of a tracked connection, the values have to match the CT_* defines in firewall_container.c
+const (
+	ctNew         uint8 = 1
+	ctEstablished uint8 = 2
+	ctClosing     uint8 = 3
+)
+
+var ctStateNames = map[uint8]string{
+	ctNew:         "NEW",
+	ctEstablished: "ESTABLISHED",
+	ctClosing:     "CLOSING",
+}
+
+// how long a connection may be idle before it is removed, per state
+var ctTimeouts = map[uint8]time.Duration{
+	ctNew:         30 * time.Second,
+	ctEstablished: time.Hour,
+	ctClosing:     10 * time.Second,
+}
+
+// udp and icmp have no end of a connection, so they expire sooner
+var ctDatagramTimeouts = map[uint8]time.Duration{
+	ctNew:         30 * time.Second,
+	ctEstablished: 3 * time.Minute,
+}
+
+func (f flow) timeout() time.Duration {
+	if f.Key.Proto == protocolNumbers["tcp"] {
+		return ctTimeouts[f.Entry.State]
+	}
+	return ctDatagramTimeouts[f.Entry.State]
+}
+
+func protocolName(proto uint8) string {
+	for name, number := range protocolNumbers {
+		if number == proto {
+			return name
+		}
+	}
+	return fmt.Sprint(proto)
+}
+
+/*
+ * key and value of map_conntrack
+ * the layout has to match struct ct_key and struct ct_entry in firewall_container.c
+ * addresses and ports are in network byte order, IPv4 addresses are IPv4-mapped
+ */
+type ctKey struct {
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort uint16
+	DstPort uint16
+	Proto   uint8
+	_       [3]byte
+	Ifindex uint32
+}
+
+type ctEntry struct {
+	LastSeenNs uint64
+	Ifindex    uint32
+	State      uint8
+	Direction  uint8
+	_          uint16
+}
+
+// a tracked connection
+type flow struct {
+	Key   ctKey
+	Entry ctEntry
+}
+
+// network byte order port as it is stored in the map
+func ctPort(p uint16) uint16 {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], p)
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (f flow) String() string {
+	src := netip.AddrPortFrom(netip.AddrFrom16(f.Key.SrcIP).Unmap(), ctPort(f.Key.SrcPort))
+	dst := netip.AddrPortFrom(netip.AddrFrom16(f.Key.DstIP).Unmap(), ctPort(f.Key.DstPort))
+	dir := "out"
+	if f.Entry.Direction == ruleDirIn {
+		dir = "in"
+	}
+	return fmt.Sprintf("%s %s -> %s %s %s ifindex=%d", protocolName(f.Key.Proto), src, dst, dir, ctStateNames[f.Entry.State], f.Entry.Ifindex)
+}
+
+// time of the clock bpf_ktime_get_ns() uses
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return uint64(ts.Nano())
+}
+
+/*
+ * Return the tracked connections of the given interfaces (all connections if ifindexes is nil).
+ */
+func listFlows(m *ebpf.Map, ifindexes map[uint32]bool) ([]flow, error) {
+	var flows []flow
+	var f flow
+	iter := m.Iterate()
+	for iter.Next(&f.Key, &f.Entry) {
+		if ifindexes == nil || ifindexes[f.Entry.Ifindex] {
+			flows = append(flows, f)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterating conntrack map: %w", err)
+	}
+	return flows, nil
+}
+
+/*
+ * Delete the tracked connections of the given interfaces (all connections if ifindexes is nil),
+ * their next packets are checked against the rules again.
+ */
+func flushFlows(m *ebpf.Map, ifindexes map[uint32]bool) (int, error) {
+	flows, err := listFlows(m, ifindexes)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, f := range flows {
+		if err := m.Delete(f.Key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete tracked connection %s: %v", f, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// remove connections that were idle for longer than the timeout of their state
+func expireFlows(m *ebpf.Map) {
+	flows, err := listFlows(m, nil)
+	if err != nil {
+		log.Printf("Could not read tracked connections: %v", err)
+		return
+	}
+	now := monotonicNow()
+	for _, f := range flows {
+		idle := time.Duration(now - f.Entry.LastSeenNs)
+		if idle < f.timeout() {
+			continue
+		}
+		if err := m.Delete(f.Key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to expire tracked connection %s: %v", f, err)
+		}
+	}
+}
+
+/*
+ * Find the veths of a container (full id, id prefix or name) in filtered_logs
+ * and return their interface indexes.
+ */
+func containerIfindexes(db *sql.DB, container string) (map[uint32]bool, error) {
+	rows, err := db.Query(`SELECT container_id, veth FROM filtered_logs WHERE action != 'destroy'`)
+	if err != nil {
+		return nil, fmt.Errorf("querying filtered_logs: %w", err)
+	}
+	defer rows.Close()
+
+	vethsByID := make(map[string]string)
+	for rows.Next() {
+		var id, csv string
+		if err := rows.Scan(&id, &csv); err == nil {
+			vethsByID[id] = csv
+		}
+	}
+
+	// names are only known to docker
+	ids := make(map[string]struct{}, len(vethsByID))
+	for id := range vethsByID {
+		ids[id] = struct{}{}
+	}
+	metas := inspectContainers(ids)
+
+	ifindexes := make(map[uint32]bool)
+	for id, csv := range vethsByID {
+		if !strings.HasPrefix(id, container) && metas[id].Name != container {
+			continue
+		}
+		for _, name := range strings.Split(csv, ",") {
+			iface, err := net.InterfaceByName(strings.TrimSpace(name))
+			if err == nil {
+				ifindexes[uint32(iface.Index)] = true
+			}
+		}
+	}
+	if len(ifindexes) == 0 {
+		return nil, fmt.Errorf("no interface of container %q found", container)
+	}
+	return ifindexes, nil
+}
+
+/*
+ * firewall_container conntrack list [container]
+ * firewall_container conntrack flush [container]
+ * works on the pinned map of the running firewall
+ */
+func runConntrackCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "flush") {
+		return errors.New("usage: firewall_container conntrack list|flush [container]")
+	}
+
+	m, err := ebpf.LoadPinnedMap(conntrackMapPath, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the firewall running?): %w", conntrackMapPath, err)
+	}
+	defer m.Close()
+
+	var ifindexes map[uint32]bool
+	if len(args) > 1 {
+		if ifindexes, err = containerIfindexes(db, args[1]); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		flows, err := listFlows(m, ifindexes)
+		if err != nil {
+			return err
+		}
+		for _, f := range flows {
+			fmt.Fprintln(os.Stdout, f)
+		}
+	case "flush":
+		deleted, err := flushFlows(m, ifindexes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("flushed %d tracked connections\n", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cilium/ebpf"
+)
+
+// pinned by the bpf program (LIBBPF_PIN_BY_NAME), so the CLI can read it while the firewall runs
+const countersMapPath = "/sys/fs/bpf/maps/map_counters"
+
+// default address of the metrics endpoint
+const metricsAddr = "127.0.0.1:9464"
+
+// what decided about a packet, the values have to match the COUNT_* defines in firewall_container.c
+const (
+	countDefault uint16 = maxPortRules + iota
+	countUnknownProto
+	countConntrack
+	countCIDRList
+	countMalformed
+	countUnfiltered
+	countSegment
+)
+
+var countNames = map[uint16]string{
+	countDefault:      "default",
+	countUnknownProto: "unknown_protocol",
+	countConntrack:    "conntrack",
+	countCIDRList:     "cidr_list",
+	countMalformed:    "malformed",
+	countUnfiltered:   "unfiltered",
+	countSegment:      "segment",
+}
+
+var verdictNames = map[uint8]string{
+	ruleActionAllow: "allow",
+	ruleActionDeny:  "deny",
+}
+
+/*
+ * key and value of map_counters
+ * the layout has to match struct counter_key and struct counter in firewall_container.c
+ */
+type counterKey struct {
+	Ifindex   uint32
+	Slot      uint16
+	Direction uint8
+	Verdict   uint8
+}
+
+type counterValue struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// read map_counters and add up the copies of every cpu
+func readCounters(m *ebpf.Map) (map[counterKey]counterValue, error) {
+	totals := make(map[counterKey]counterValue)
+	var key counterKey
+	var perCPU []counterValue
+	iter := m.Iterate()
+	for iter.Next(&key, &perCPU) {
+		var sum counterValue
+		for _, v := range perCPU {
+			sum.Packets += v.Packets
+			sum.Bytes += v.Bytes
+		}
+		totals[key] = sum
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterating counters map: %w", err)
+	}
+	return totals, nil
+}
+
+/*
+ * Delete the counters of the given interfaces and directions, in a single pass over the map.
+ * The value of resets says whether only the counters of port rules go (true) or all of them.
+ */
+func resetCounters(m *ebpf.Map, resets map[rulesKey]bool) {
+	if len(resets) == 0 {
+		return
+	}
+	totals, err := readCounters(m)
+	if err != nil {
+		log.Printf("Could not read counters: %v", err)
+		return
+	}
+	for key := range totals {
+		onlyRules, ok := resets[rulesKey{Ifindex: key.Ifindex, Direction: uint32(key.Direction)}]
+		if !ok || (onlyRules && key.Slot >= maxPortRules) {
+			continue
+		}
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete counter of ifindex %d: %v", key.Ifindex, err)
+		}
+	}
+}
+
+func (r RuleConfig) String() string {
+	parts := []string{r.Protocol}
+	if r.CIDR != "" {
+		parts = append(parts, r.CIDR)
+	}
+	if r.SrcPorts != "" {
+		parts = append(parts, "src "+r.SrcPorts)
+	}
+	if r.DstPorts != "" {
+		parts = append(parts, "dst "+r.DstPorts)
+	}
+	if r.ICMPType != "" {
+		parts = append(parts, "type "+r.ICMPType)
+	}
+	if r.ICMPCode != "" {
+		parts = append(parts, "code "+r.ICMPCode)
+	}
+	return strings.Join(append(parts, r.Action), " ")
+}
+
+// a counter with the names of what it counts
+type counterStat struct {
+	Container   string
+	ContainerID string
+	Interface   string
+	Direction   string
+	Verdict     string
+	// the index of the port rule, or one of countNames
+	Reason  string
+	RuleSet string
+	// the port rule, empty for the other reasons
+	Rule string
+	counterValue
+}
+
+/*
+ * Read the counters and attach the names of the containers, interfaces and rules.
+ * The rule sets are resolved the same way updateRules does, from the configuration and labels.
+ */
+func collectStats(db *sql.DB, m *ebpf.Map) ([]counterStat, error) {
+	totals, err := readCounters(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// veth name -> container id
+	rows, err := db.Query(`SELECT container_id, veth FROM filtered_logs WHERE action != 'destroy'`)
+	if err != nil {
+		return nil, fmt.Errorf("querying filtered_logs: %w", err)
+	}
+	defer rows.Close()
+	containerOf := make(map[string]string)
+	ids := make(map[string]struct{})
+	for rows.Next() {
+		var id, csv string
+		if err := rows.Scan(&id, &csv); err != nil {
+			continue
+		}
+		ids[id] = struct{}{}
+		for _, name := range strings.Split(csv, ",") {
+			containerOf[strings.TrimSpace(name)] = id
+		}
+	}
+	metas := inspectContainers(ids)
+
+	cfg, err := loadRulesConfig(rulesConfigPath)
+	if err != nil {
+		cfg = defaultRulesConfig()
+	}
+
+	stats := make([]counterStat, 0, len(totals))
+	for key, value := range totals {
+		stat := counterStat{
+			Direction:    directionLabels[key.Direction],
+			Verdict:      verdictNames[key.Verdict],
+			counterValue: value,
+		}
+		if iface, err := net.InterfaceByIndex(int(key.Ifindex)); err == nil {
+			stat.Interface = iface.Name
+		} else {
+			stat.Interface = fmt.Sprint(key.Ifindex)
+		}
+		id := containerOf[stat.Interface]
+		meta := metas[id]
+		stat.ContainerID = shortID(id)
+		stat.Container = meta.Name
+
+		name, set := cfg.resolve(meta.Name, meta.Labels, key.Direction)
+		stat.RuleSet = name
+		if key.Slot < maxPortRules {
+			stat.Reason = fmt.Sprintf("rule %d", key.Slot)
+			if int(key.Slot) < len(set.Rules) {
+				stat.Rule = set.Rules[key.Slot].String()
+			}
+		} else {
+			stat.Reason = countNames[key.Slot]
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Container != b.Container {
+			return a.Container < b.Container
+		}
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Reason < b.Reason
+	})
+	return stats, nil
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+/*
+ * firewall_container counters [container]
+ * prints every counter and the totals per interface and verdict
+ */
+func runCountersCommand(db *sql.DB, args []string) error {
+	m, err := ebpf.LoadPinnedMap(countersMapPath, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the firewall running?): %w", countersMapPath, err)
+	}
+	defer m.Close()
+
+	stats, err := collectStats(db, m)
+	if err != nil {
+		return err
+	}
+
+	type total struct{ iface, direction, verdict string }
+	totals := make(map[total]counterValue)
+	var order []total
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tINTERFACE\tDIR\tVERDICT\tREASON\tRULE\tPACKETS\tBYTES")
+	for _, s := range stats {
+		if len(args) > 0 && s.Container != args[0] && !strings.HasPrefix(s.ContainerID, args[0]) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			s.Container, s.Interface, s.Direction, s.Verdict, s.Reason, s.Rule, s.Packets, s.Bytes)
+
+		t := total{s.Interface, s.Direction, s.Verdict}
+		if _, ok := totals[t]; !ok {
+			order = append(order, t)
+		}
+		v := totals[t]
+		v.Packets += s.Packets
+		v.Bytes += s.Bytes
+		totals[t] = v
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "INTERFACE\tDIR\tVERDICT\tPACKETS\tBYTES")
+	for _, t := range order {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", t.iface, t.direction, t.verdict, totals[t].Packets, totals[t].Bytes)
+	}
+	return w.Flush()
+}
+
+// escape a prometheus label value
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+/*
+ * Serve the counters in the prometheus text format on /metrics.
+ * Every counter is read when it is scraped, nothing is cached.
+ */
+func serveMetrics(addr string, db *sql.DB, m *ebpf.Map) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := collectStats(db, m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		metrics := []struct {
+			name, help string
+			value      func(counterStat) uint64
+		}{
+			{"firewall_container_packets_total", "Packets seen by the container firewall.", func(s counterStat) uint64 { return s.Packets }},
+			{"firewall_container_bytes_total", "Bytes seen by the container firewall.", func(s counterStat) uint64 { return s.Bytes }},
+		}
+		for _, metric := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+			for _, s := range stats {
+				fmt.Fprintf(w, "%s{container=\"%s\",container_id=\"%s\",interface=\"%s\",direction=\"%s\",verdict=\"%s\",reason=\"%s\",rule_set=\"%s\",rule=\"%s\"} %d\n",
+					metric.name, labelValue(s.Container), s.ContainerID, labelValue(s.Interface), s.Direction,
+					s.Verdict, s.Reason, labelValue(s.RuleSet), labelValue(s.Rule), metric.value(s))
+			}
+		}
+	})
+
+	log.Printf("Serving firewall metrics on http://%s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Metrics endpoint stopped: %v", err)
+	}
+}
@@ -6,62 +6,788 @@
 #include <bpf/bpf_helpers.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/pkt_cls.h>
 #include <linux/tcp.h>
+#include <linux/udp.h>
 #include <netinet/in.h>
 #include <stdbool.h>
 
-#define ALLOWED_SRC_PORT 1234
-#define ALLOWED_DST_PORT 80
+// rule slots per interface
+#define MAX_PORT_RULES 16
 
-SEC("tc")
-// *skb is a pointer to a bpf context struct that the kernel hands this bpf
-// program when it's invoked at the tc hook.
-int tc_ingress_program(struct __sk_buff *skb) {
+// IPv6 extension headers walked before giving up on finding the l4 header
+#define MAX_IPV6_EXT_HDRS 8
+
+// IPv4 addresses are stored as IPv4-mapped IPv6 addresses (::ffff:a.b.c.d)
+#define IPV4_MAPPED_PREFIX 96
+
+/*
+ * direction of a packet, seen from the container
+ * tc_ingress_program runs at the ingress of the host side of the container's
+ * veth and sees what the container sends (RULE_DIR_OUT), tc_egress_program
+ * runs at its egress and sees what is sent to the container (RULE_DIR_IN)
+ */
+#define RULE_DIR_OUT 1
+#define RULE_DIR_IN 2
+
+// values of port_rule.action and port_rules.default_action
+#define RULE_ACTION_ALLOW 1
+#define RULE_ACTION_DENY 2
+
+/*
+ * main.go mirrors the layout of struct port_rule and struct port_rules in Go,
+ * keep both in sync
+ */
+/*
+ * for tcp and udp the ranges are source and destination ports, for icmp and
+ * icmpv6 the src range holds the icmp types and the dst range the codes
+ */
+struct port_rule {
+  /*
+   * address or network of the other side of the packet (the destination of
+   * a packet sent by the container, the source of one sent to it), IPv4
+   * networks are IPv4-mapped, prefixlen 0 matches every address
+   */
+  __u8 addr[16];
+  // port ranges in host byte order, inclusive
+  __u16 src_first;
+  __u16 src_last;
+  __u16 dst_first;
+  __u16 dst_last;
+  // IPPROTO_*
+  __u8 proto;
+  // bitmask of RULE_DIR_*
+  __u8 direction;
+  // RULE_ACTION_*
+  __u8 action;
+  // prefix length of addr in bits, 0-128
+  __u8 prefixlen;
+};
+
+struct port_rules {
+  // number of used slots in rules
+  __u32 count;
+  // RULE_ACTION_* for tcp, udp and icmp packets no rule matches
+  __u32 default_action;
+  // RULE_ACTION_* for every other ip protocol
+  __u32 unknown_action;
+  struct port_rule rules[MAX_PORT_RULES];
+};
+
+// no interface has ifindex 0
+#define RULES_DEFAULT_IFINDEX 0
+
+struct rules_key {
+  // ifindex of the host side of a container's veth
+  __u32 ifindex;
+  // RULE_DIR_OUT or RULE_DIR_IN, each direction has its own rule set
+  __u32 direction;
+};
+
+/*
+ * key:   interface and direction
+ * value: the rules of that container for that direction, written by main.go
+ * ifindex RULES_DEFAULT_IFINDEX holds the default rule set of each direction,
+ * used by interfaces that have no rules of their own yet
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct rules_key);
+  __type(value, struct port_rules);
+  __uint(max_entries, 512);
+} map_port_rules SEC(".maps");
+
+/*
+ * what decided about a packet, the slot of its counter
+ * 0 to MAX_PORT_RULES - 1 are the port rules of the interface
+ */
+#define COUNT_DEFAULT (MAX_PORT_RULES + 0)       // default_action
+#define COUNT_UNKNOWN_PROTO (MAX_PORT_RULES + 1) // unknown_action
+#define COUNT_CONNTRACK (MAX_PORT_RULES + 2)     // a tracked connection
+#define COUNT_CIDR_LIST (MAX_PORT_RULES + 3)     // the cidr lists
+#define COUNT_MALFORMED (MAX_PORT_RULES + 4)     // headers that do not parse
+// not filtered: not ip, later fragments, neighbor discovery
+#define COUNT_UNFILTERED (MAX_PORT_RULES + 5)
+#define COUNT_SEGMENT (MAX_PORT_RULES + 6) // a segment between two containers
+
+struct counter_key {
+  __u32 ifindex;
+  // COUNT_* or the index of a port rule
+  __u16 slot;
+  // RULE_DIR_*
+  __u8 direction;
+  // RULE_ACTION_*
+  __u8 verdict;
+};
+
+struct counter {
+  __u64 packets;
+  __u64 bytes;
+};
+
+/*
+ * packets and bytes per interface, direction, verdict and rule
+ * per cpu, so every cpu counts into its own copy without atomics, main.go
+ * adds them up. pinned for firewall_container counters
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+  __type(key, struct counter_key);
+  __type(value, struct counter);
+  __uint(max_entries, 16384);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_counters SEC(".maps");
+
+static __always_inline void count(struct __sk_buff *skb, __u8 direction,
+                                  __u16 slot, __u32 verdict) {
+  struct counter_key key = {
+      .ifindex = skb->ifindex,
+      .slot = slot,
+      .direction = direction,
+      .verdict = verdict,
+  };
+  struct counter *c = bpf_map_lookup_elem(&map_counters, &key);
+  if (!c) {
+    struct counter zero = {};
+    bpf_map_update_elem(&map_counters, &key, &zero, BPF_NOEXIST);
+    c = bpf_map_lookup_elem(&map_counters, &key);
+    if (!c)
+      return;
+  }
+  c->packets++;
+  c->bytes += skb->len;
+}
+
+// port ranges per pair of containers
+#define MAX_SEGMENT_PORTS 8
+
+/*
+ * segments (container to container rules), compiled by main.go from names
+ * and labels into one entry per container interface, direction and address
+ * of the other container
+ */
+struct segment_key {
+  __u32 ifindex;
+  // RULE_DIR_*
+  __u32 direction;
+  // the other container, IPv4-mapped for IPv4
+  __u8 addr[16];
+};
+
+struct segment_port {
+  // destination port range in host byte order, inclusive
+  __u16 first;
+  __u16 last;
+  // IPPROTO_*
+  __u8 proto;
+  __u8 _pad[3];
+};
+
+// what one container may send to another, count 0 allows nothing
+struct segment_rule {
+  __u32 count;
+  struct segment_port ports[MAX_SEGMENT_PORTS];
+};
+
+/*
+ * an entry only exists between containers where the receiving one is
+ * segmented, its allowed ports replace the port rules of both containers,
+ * traffic between other containers goes through the port rules as before
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct segment_key);
+  __type(value, struct segment_rule);
+  __uint(max_entries, 16384);
+} map_segments SEC(".maps");
+
+// entries of the cidr list trie
+#define MAX_CIDR_RULES 16384
+
+// key of the cidr list trie, IPv4 networks are IPv4-mapped
+struct cidr_key {
+  // prefix length in bits, 128 on lookups
+  __u32 prefixlen;
+  __u8 addr[16];
+};
+
+struct cidr_rule {
+  // RULE_ACTION_*
+  __u32 action;
+  /*
+   * only informational here: cidr_lists already resolved the priorities, the
+   * longest matching prefix carries the action of the highest priority entry
+   * covering it
+   */
+  __u32 priority;
+};
+
+/*
+ * allow and deny lists of addresses and networks, checked on the other side
+ * of every packet of every container before the port rules
+ * bpf_modules/cidr_lists mirrors the layout in Go, keep both in sync
+ */
+struct cidr_trie {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __type(key, struct cidr_key);
+  __type(value, struct cidr_rule);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(max_entries, MAX_CIDR_RULES);
+};
+
+/*
+ * the trie in use at index 0. main.go fills a new trie on every reload and
+ * swaps it in with a single update, so a packet never sees half a list
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+  __type(key, __u32);
+  __uint(max_entries, 1);
+  __array(values, struct cidr_trie);
+} map_cidr_lists SEC(".maps");
+
+// states of a tracked connection
+#define CT_NEW 1
+#define CT_ESTABLISHED 2
+#define CT_CLOSING 3
+
+/*
+ * a connection, the addresses and ports are the ones of the first packet
+ * (the direction that opened the connection), in network byte order
+ * IPv4 addresses are IPv4-mapped, so both families share the map
+ * a connection between two containers passes two veths, each one tracks it
+ * on its own, so the rules and segments of the receiver still decide about it
+ */
+struct ct_key {
+  __u8 src_ip[16];
+  __u8 dst_ip[16];
+  __u16 src_port;
+  __u16 dst_port;
+  __u8 proto;
+  __u8 _pad[3];
+  // interface the connection is tracked on
+  __u32 ifindex;
+};
+
+struct ct_entry {
+  // bpf_ktime_get_ns() of the last packet
+  __u64 last_seen_ns;
+  // interface the connection was seen on, identifies the container
+  __u32 ifindex;
+  // CT_*
+  __u8 state;
+  // RULE_DIR_* of the packet that opened the connection
+  __u8 direction;
+  __u16 _pad;
+};
+
+/*
+ * tracked connections of all containers
+ * the rules only decide about new connections, every further packet of an
+ * allowed connection (including the replies) is let through
+ * an LRU map, so connections that are never closed properly make room for
+ * new ones by themselves. main.go lists and flushes it per container
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct ct_key);
+  __type(value, struct ct_entry);
+  __uint(max_entries, 65536);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_conntrack SEC(".maps");
+
+// whether the first prefixlen bits of addr and the rule's address are equal
+static __always_inline bool match_prefix(const __u8 *addr,
+                                         const struct port_rule *r) {
+  __u32 bits = r->prefixlen;
+  for (__u32 i = 0; i < 16; i++) {
+    if (bits == 0)
+      return true;
+    __u8 mask = bits >= 8 ? 0xff : (__u8)(0xff << (8 - bits));
+    if ((addr[i] ^ r->addr[i]) & mask)
+      return false;
+    bits = bits >= 8 ? bits - 8 : 0;
+  }
+  return true;
+}
+
+/*
+ * return the action of the cidr lists for an address, 0 if no list entry
+ * matches or no lists are loaded
+ */
+static __always_inline __u32 match_cidr_lists(const __u8 *addr) {
+  __u32 zero = 0;
+  void *trie = bpf_map_lookup_elem(&map_cidr_lists, &zero);
+  if (!trie)
+    return 0;
+
+  struct cidr_key key = {.prefixlen = 128};
+  __builtin_memcpy(key.addr, addr, sizeof(key.addr));
+  struct cidr_rule *rule = bpf_map_lookup_elem(trie, &key);
+  if (!rule)
+    return 0;
+  return rule->action;
+}
+
+/*
+ * return the action of the first rule that matches the packet,
+ * the default action of the interface if none matches
+ * remote is the address of the other side, not the container
+ * slot is set to the index of the rule or COUNT_DEFAULT
+ */
+static __always_inline __u32 match_port_rules(struct port_rules *rules,
+                                              __u8 proto, __u8 direction,
+                                              const __u8 *remote,
+                                              __u16 src_port, __u16 dst_port,
+                                              __u16 *slot) {
+  for (__u32 i = 0; i < MAX_PORT_RULES; i++) {
+    if (i >= rules->count)
+      break;
+
+    struct port_rule *r = &rules->rules[i];
+    if (r->proto != proto || !(r->direction & direction))
+      continue;
+    if (!match_prefix(remote, r))
+      continue;
+    if (src_port < r->src_first || src_port > r->src_last)
+      continue;
+    if (dst_port < r->dst_first || dst_port > r->dst_last)
+      continue;
+    *slot = i;
+    return r->action;
+  }
+  *slot = COUNT_DEFAULT;
+  return rules->default_action;
+}
+
+// RULE_ACTION_ALLOW if the segment allows the destination port, deny if not
+static __always_inline __u32 match_segment(struct segment_rule *seg, __u8 proto,
+                                           __u16 dst_port) {
+  for (__u32 i = 0; i < MAX_SEGMENT_PORTS; i++) {
+    if (i >= seg->count)
+      break;
+
+    struct segment_port *p = &seg->ports[i];
+    if (p->proto == proto && dst_port >= p->first && dst_port <= p->last)
+      return RULE_ACTION_ALLOW;
+  }
+  return RULE_ACTION_DENY;
+}
+
+// the swapped tuple, the key of the reply direction
+static __always_inline struct ct_key ct_reverse(const struct ct_key *key) {
+  struct ct_key rev = {
+      .src_port = key->dst_port,
+      .dst_port = key->src_port,
+      .proto = key->proto,
+      .ifindex = key->ifindex,
+  };
+  __builtin_memcpy(rev.src_ip, key->dst_ip, sizeof(rev.src_ip));
+  __builtin_memcpy(rev.dst_ip, key->src_ip, sizeof(rev.dst_ip));
+  return rev;
+}
+
+// icmp and icmpv6 share the layout of the first 8 bytes of an echo message
+struct icmp_echo_hdr {
+  __u8 type;
+  __u8 code;
+  __sum16 checksum;
+  __be16 id;
+  __be16 sequence;
+};
+
+#define ICMP_ECHO_REPLY 0
+#define ICMP_ECHO_REQUEST 8
+#define ICMPV6_ECHO_REQUEST 128
+#define ICMPV6_ECHO_REPLY 129
+/*
+ * router/neighbor solicitation and advertisement, a redirect (137) goes
+ * through the rules like any other icmpv6 message
+ */
+#define ICMPV6_NDP_FIRST 133
+#define ICMPV6_NDP_LAST 136
+
+// the l4 part of a packet
+struct l4 {
+  // what the rules compare: ports in host byte order, or icmp type and code
+  __u16 match_src;
+  __u16 match_dst;
+  // the ports of the conntrack key in network byte order, the echo id for icmp
+  __be16 ct_src;
+  __be16 ct_dst;
+  // whether the packet belongs to something conntrack can follow
+  bool track;
+  // the packet may open a new entry (a tcp SYN, an echo request)
+  bool opens;
+  // tcp flags
+  bool fin;
+  bool rst;
+};
+
+/*
+ * move a tracked connection forward by the packet
+ * a tcp RST ends it, a FIN marks it as closing so the last ACKs still pass and
+ * main.go removes it once it is idle
+ * an entry that is gone makes the next packet of the tuple a new connection
+ * that the rules decide about again
+ */
+static __always_inline void ct_update(struct ct_key *key, struct ct_entry *ct,
+                                      struct l4 *l4, bool reply) {
+  ct->last_seen_ns = bpf_ktime_get_ns();
+
+  if (l4->rst) {
+    bpf_map_delete_elem(&map_conntrack, key);
+    return;
+  }
+  if (l4->fin) {
+    ct->state = CT_CLOSING;
+    return;
+  }
+  // the other side answered
+  if (reply && ct->state == CT_NEW)
+    ct->state = CT_ESTABLISHED;
+}
+
+// fragment extension header, see RFC 8200
+struct ipv6_frag_hdr {
+  __u8 nexthdr;
+  __u8 reserved;
+  // offset in 8 byte units (upper 13 bits) and flags
+  __be16 frag_off;
+  __be32 identification;
+};
+
+// the l3 part of a packet, what the rules and the conntrack look at
+struct packet {
+  // IPv4-mapped for IPv4
+  __u8 src_ip[16];
+  __u8 dst_ip[16];
+  // IPPROTO_* of the l4 header
+  __u8 proto;
+  // offset of the l4 header from the start of the packet
+  __u32 l4_off;
+  // not the first fragment, there is no l4 header to look at
+  bool fragment;
+};
+
+static __always_inline void ipv4_mapped(__u8 *dst, __be32 addr) {
+  __builtin_memset(dst, 0, 10);
+  dst[10] = 0xff;
+  dst[11] = 0xff;
+  __builtin_memcpy(dst + 12, &addr, 4);
+}
+
+// return -1 if the header is malformed
+static __always_inline int parse_ipv4(struct __sk_buff *skb, __u32 off,
+                                      struct packet *pkt) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+
+  // parse IP header
+  struct iphdr *ip = data + off;
+  if ((void *)ip + sizeof(*ip) > data_end || ip->ihl < 5)
+    return -1;
+
+  ipv4_mapped(pkt->src_ip, ip->saddr);
+  ipv4_mapped(pkt->dst_ip, ip->daddr);
+  pkt->proto = ip->protocol;
+  // compute IP header length in bytes
+  pkt->l4_off = off + ip->ihl * 4;
+  // only the first fragment carries the ports
+  pkt->fragment = (bpf_ntohs(ip->frag_off) & 0x1fff) != 0;
+  return 0;
+}
+
+/*
+ * walk the extension headers up to the l4 header
+ * return -1 if a header is malformed or there are too many of them
+ */
+static __always_inline int parse_ipv6(struct __sk_buff *skb, __u32 off,
+                                      struct packet *pkt) {
+  struct ipv6hdr ip6;
+  if (bpf_skb_load_bytes(skb, off, &ip6, sizeof(ip6)) < 0)
+    return -1;
+
+  __builtin_memcpy(pkt->src_ip, &ip6.saddr, sizeof(pkt->src_ip));
+  __builtin_memcpy(pkt->dst_ip, &ip6.daddr, sizeof(pkt->dst_ip));
+  pkt->fragment = false;
+
+  __u8 nexthdr = ip6.nexthdr;
+  off += sizeof(ip6);
+
+  for (int i = 0; i < MAX_IPV6_EXT_HDRS; i++) {
+    switch (nexthdr) {
+    case IPPROTO_HOPOPTS:
+    case IPPROTO_ROUTING:
+    case IPPROTO_DSTOPTS: {
+      // length in 8 byte units, not counting the first 8 bytes
+      struct ipv6_opt_hdr opt;
+      if (bpf_skb_load_bytes(skb, off, &opt, sizeof(opt)) < 0)
+        return -1;
+      nexthdr = opt.nexthdr;
+      off += (opt.hdrlen + 1) * 8;
+      break;
+    }
+    case IPPROTO_AH: {
+      // length in 4 byte units, not counting the first 8 bytes
+      struct ipv6_opt_hdr opt;
+      if (bpf_skb_load_bytes(skb, off, &opt, sizeof(opt)) < 0)
+        return -1;
+      nexthdr = opt.nexthdr;
+      off += (opt.hdrlen + 2) * 4;
+      break;
+    }
+    case IPPROTO_FRAGMENT: {
+      struct ipv6_frag_hdr frag;
+      if (bpf_skb_load_bytes(skb, off, &frag, sizeof(frag)) < 0)
+        return -1;
+      if (bpf_ntohs(frag.frag_off) & 0xfff8)
+        pkt->fragment = true;
+      nexthdr = frag.nexthdr;
+      off += sizeof(frag);
+      break;
+    }
+    default:
+      // the l4 header (or ESP / no next header, which are never matched)
+      pkt->proto = nexthdr;
+      pkt->l4_off = off;
+      return 0;
+    }
+  }
+  return -1;
+}
+
+/*
+ * read the tcp, udp or icmp header behind the ip header(s)
+ * return -1 if it is malformed, 1 for any other protocol
+ */
+static __always_inline int parse_l4(struct __sk_buff *skb,
+                                    const struct packet *pkt, struct l4 *l4) {
+  switch (pkt->proto) {
+  case IPPROTO_TCP: {
+    // at a variable offset behind the extension headers
+    struct tcphdr tcp;
+    if (bpf_skb_load_bytes(skb, pkt->l4_off, &tcp, sizeof(tcp)) < 0)
+      return -1;
+    // read ports (in network order → convert to host order)
+    l4->match_src = bpf_ntohs(tcp.source);
+    l4->match_dst = bpf_ntohs(tcp.dest);
+    l4->ct_src = tcp.source;
+    l4->ct_dst = tcp.dest;
+    l4->track = true;
+    l4->opens = tcp.syn && !tcp.ack;
+    l4->fin = tcp.fin;
+    l4->rst = tcp.rst;
+    return 0;
+  }
+  case IPPROTO_UDP: {
+    struct udphdr udp;
+    if (bpf_skb_load_bytes(skb, pkt->l4_off, &udp, sizeof(udp)) < 0)
+      return -1;
+    l4->match_src = bpf_ntohs(udp.source);
+    l4->match_dst = bpf_ntohs(udp.dest);
+    l4->ct_src = udp.source;
+    l4->ct_dst = udp.dest;
+    l4->track = true;
+    return 0;
+  }
+  case IPPROTO_ICMP:
+  case IPPROTO_ICMPV6: {
+    struct icmp_echo_hdr icmp;
+    if (bpf_skb_load_bytes(skb, pkt->l4_off, &icmp, sizeof(icmp)) < 0)
+      return -1;
+    l4->match_src = icmp.type;
+    l4->match_dst = icmp.code;
+
+    /*
+     * echo requests and replies are tracked by their id, used on both sides
+     * of the key so a reply finds the request with the swapped key
+     */
+    bool request = pkt->proto == IPPROTO_ICMP
+                       ? icmp.type == ICMP_ECHO_REQUEST
+                       : icmp.type == ICMPV6_ECHO_REQUEST;
+    bool reply = pkt->proto == IPPROTO_ICMP ? icmp.type == ICMP_ECHO_REPLY
+                                            : icmp.type == ICMPV6_ECHO_REPLY;
+    if (request || reply) {
+      l4->ct_src = icmp.id;
+      l4->ct_dst = icmp.id;
+      l4->track = true;
+      l4->opens = request;
+    }
+    return 0;
+  }
+  default:
+    return 1;
+  }
+}
+
+/*
+ * decide about a packet that is sent by (RULE_DIR_OUT) or to (RULE_DIR_IN) the
+ * container behind the interface, return RULE_ACTION_* and set slot to what
+ * decided
+ */
+static __always_inline __u32 decide(struct __sk_buff *skb, __u8 direction,
+                                    __u16 *slot) {
   // set up pointers to the start/end of packet data
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
 
   // parse Ethernet header
   struct ethhdr *eth = data;
-  if ((void *)eth + sizeof(*eth) > data_end)
-    return TC_ACT_SHOT; // if malformed, drop
+  if ((void *)eth + sizeof(*eth) > data_end) {
+    *slot = COUNT_MALFORMED;
+    return RULE_ACTION_DENY; // if malformed, drop
+  }
 
-  // check ethernet protocol
-  if (eth->h_proto != bpf_htons(ETH_P_IP))
-    return TC_ACT_OK; // if packet is not IPv4, let it through
+  // check ethernet protocol, IPv4 and IPv6 go through the same rules
+  struct packet pkt = {};
+  struct l4 l4 = {};
+  int err;
+  if (eth->h_proto == bpf_htons(ETH_P_IP))
+    err = parse_ipv4(skb, sizeof(*eth), &pkt);
+  else if (eth->h_proto == bpf_htons(ETH_P_IPV6))
+    err = parse_ipv6(skb, sizeof(*eth), &pkt);
+  else
+    return RULE_ACTION_ALLOW; // if packet is not IP, let it through
+  if (err < 0) {
+    *slot = COUNT_MALFORMED;
+    return RULE_ACTION_DENY; // if malformed, drop
+  }
 
-  // parse IP header
-  struct iphdr *ip = data + sizeof(*eth);
-  if ((void *)ip + sizeof(*ip) > data_end)
-    return TC_ACT_SHOT; // if malformed, drop
+  // the other side is the destination of what the container sends
+  const __u8 *remote = direction == RULE_DIR_OUT ? pkt.dst_ip : pkt.src_ip;
 
-  // check for TCP
-  if (ip->protocol != IPPROTO_TCP)
-    return TC_ACT_OK; // if packet is not TCP, let it through
+  /*
+   * the cidr lists come first, a denied address also cuts connections that
+   * are already tracked, an allowed one skips the port rules
+   */
+  __u32 listed = match_cidr_lists(remote);
+  if (listed) {
+    *slot = COUNT_CIDR_LIST;
+    return listed;
+  }
 
-  // compute IP header length in bytes
-  __u32 ip_hdr_len = ip->ihl * 4;
+  /*
+   * later fragments have no ports, they are useless to the container without
+   * the first fragment, which went through the rules
+   */
+  if (pkt.fragment)
+    return RULE_ACTION_ALLOW;
 
-  // parse TCP header
-  struct tcphdr *tcp = (void *)ip + ip_hdr_len;
-  if ((void *)tcp + sizeof(*tcp) > data_end)
-    return TC_ACT_SHOT; // if malformed, drop
+  // the rules of the container behind this interface for this direction
+  __u32 ifindex = skb->ifindex;
+  struct rules_key rkey = {.ifindex = ifindex, .direction = direction};
+  struct port_rules *rules = bpf_map_lookup_elem(&map_port_rules, &rkey);
+  if (!rules) {
+    // not mapped to its container yet, the default rule set applies
+    rkey.ifindex = RULES_DEFAULT_IFINDEX;
+    rules = bpf_map_lookup_elem(&map_port_rules, &rkey);
+  }
+  if (!rules) {
+    // not even the default rule set is written, fail closed
+    *slot = COUNT_DEFAULT;
+    return RULE_ACTION_DENY;
+  }
 
-  // read ports (in network order → convert to host order)
-  __u16 src_port = bpf_ntohs(tcp->source);
-  __u16 dst_port = bpf_ntohs(tcp->dest);
+  err = parse_l4(skb, &pkt, &l4);
+  if (err < 0) {
+    *slot = COUNT_MALFORMED;
+    return RULE_ACTION_DENY; // if malformed, drop
+  }
+  if (err > 0) {
+    // neither tcp, udp nor icmp
+    *slot = COUNT_UNKNOWN_PROTO;
+    return rules->unknown_action;
+  }
+
+  // IPv6 does not work without neighbor discovery
+  if (pkt.proto == IPPROTO_ICMPV6 && l4.match_src >= ICMPV6_NDP_FIRST &&
+      l4.match_src <= ICMPV6_NDP_LAST)
+    return RULE_ACTION_ALLOW;
+
+  // packets of known connections pass without looking at the rules
+  struct ct_key key = {
+      .src_port = l4.ct_src,
+      .dst_port = l4.ct_dst,
+      .proto = pkt.proto,
+      .ifindex = ifindex,
+  };
+  __builtin_memcpy(key.src_ip, pkt.src_ip, sizeof(key.src_ip));
+  __builtin_memcpy(key.dst_ip, pkt.dst_ip, sizeof(key.dst_ip));
+  if (l4.track) {
+    struct ct_entry *ct = bpf_map_lookup_elem(&map_conntrack, &key);
+    if (ct) {
+      ct_update(&key, ct, &l4, false);
+      *slot = COUNT_CONNTRACK;
+      return RULE_ACTION_ALLOW;
+    }
+    struct ct_key rev = ct_reverse(&key);
+    ct = bpf_map_lookup_elem(&map_conntrack, &rev);
+    if (ct) {
+      ct_update(&rev, ct, &l4, true);
+      *slot = COUNT_CONNTRACK;
+      return RULE_ACTION_ALLOW;
+    }
+  }
 
-  // enforce TCP port policy (both directions)
-  bool forward = (src_port == 1234 && dst_port == 80);
-  bool back = (src_port == 80 && dst_port == 1234);
-  if (!(forward || back)) {
+  // between two containers a segment decides instead of the port rules
+  struct segment_key skey = {.ifindex = ifindex, .direction = direction};
+  __builtin_memcpy(skey.addr, remote, sizeof(skey.addr));
+  struct segment_rule *seg = bpf_map_lookup_elem(&map_segments, &skey);
+  __u32 verdict;
+  if (seg) {
+    *slot = COUNT_SEGMENT;
+    verdict = match_segment(seg, pkt.proto, l4.match_dst);
+  } else {
+    verdict = match_port_rules(rules, pkt.proto, direction, remote,
+                               l4.match_src, l4.match_dst, slot);
+  }
+  if (verdict == RULE_ACTION_DENY) {
     // red light
-    return TC_ACT_SHOT;
+    return RULE_ACTION_DENY;
+  }
+
+  /*
+   * green light, remember the connection
+   * a SYN or the first datagram opens a new connection, anything else (e.g. a
+   * connection that was open before the firewall started) is picked up as
+   * established. icmp only tracks echo requests, their replies pass
+   */
+  bool icmp = pkt.proto == IPPROTO_ICMP || pkt.proto == IPPROTO_ICMPV6;
+  if (l4.track && !l4.rst && !l4.fin && (!icmp || l4.opens)) {
+    struct ct_entry entry = {
+        .last_seen_ns = bpf_ktime_get_ns(),
+        .ifindex = ifindex,
+        .state = (l4.opens || pkt.proto == IPPROTO_UDP) ? CT_NEW
+                                                         : CT_ESTABLISHED,
+        .direction = direction,
+    };
+    bpf_map_update_elem(&map_conntrack, &key, &entry, BPF_ANY);
   }
+  return RULE_ACTION_ALLOW;
+}
 
-  // green light
-  return TC_ACT_OK;
+// shared by both programs: decide about a packet and count it
+static __always_inline int filter(struct __sk_buff *skb, __u8 direction) {
+  __u16 slot = COUNT_UNFILTERED;
+  __u32 verdict = decide(skb, direction, &slot);
+  count(skb, direction, slot, verdict);
+  return verdict == RULE_ACTION_DENY ? TC_ACT_SHOT : TC_ACT_OK;
+}
+
+SEC("tc")
+// *skb is a pointer to a bpf context struct that the kernel hands this bpf
+// program when it's invoked at the tc hook.
+int tc_ingress_program(struct __sk_buff *skb) {
+  // ingress of the host side of the veth: sent by the container
+  return filter(skb, RULE_DIR_OUT);
+}
+
+SEC("tc")
+int tc_egress_program(struct __sk_buff *skb) {
+  // egress of the host side of the veth: sent to the container
+  return filter(skb, RULE_DIR_IN);
 }
 
 char LICENSE[] SEC("license") = "GPL";
@@ -2,91 +2,298 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"cidr_lists"
+
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	_ "modernc.org/sqlite"
 )
 
+// default cidr list, relative to the working directory (john_wick)
+const cidrListsPath = "firewall_cidrs.list"
+
+// subscribe to netlink link events, closing done ends the subscription
+func subscribeLinks() (chan netlink.LinkUpdate, chan struct{}, error) {
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		close(done)
+		return nil, nil, err
+	}
+	return updates, done, nil
+}
+
 /*
- * Attache the firewall to with what's currently recorded in the filtered_logs database.
- * - Attaches to any new veths
- * - Detaches from any veths that have been removed
+ * docker names the host side of a container's veth pair veth<hash>, the manager relies on the same,
+ * and plugs it into docker0 or the br-<network id> bridge of a user-defined network
+ * veths of anything else (libvirt, other runtimes, a veth that is not plugged in yet) are left alone
  */
-func updateAttachments(db *sql.DB, prog *ebpf.Program, attached map[string]link.Link) {
-	// fetch the comma-seperated 'veth' column
-	rows, err := db.Query(`SELECT veth FROM filtered_logs WHERE action != 'destroy'`)
+func isContainerVeth(l netlink.Link) bool {
+	if l.Type() != "veth" || !strings.HasPrefix(l.Attrs().Name, "veth") {
+		return false
+	}
+	return isDockerBridge(l.Attrs().MasterIndex)
+}
+
+func isDockerBridge(index int) bool {
+	if index == 0 {
+		return false
+	}
+	master, err := netlink.LinkByIndex(index)
 	if err != nil {
-		log.Printf("Error querying filtered_logs: %v", err)
+		return false
+	}
+	name := master.Attrs().Name
+	return master.Type() == "bridge" && (name == "docker0" || strings.HasPrefix(name, "br-"))
+}
+
+// link events come in bursts (a container start sends several), the rules are applied once after them
+const linkSettleDelay = 500 * time.Millisecond
+
+/*
+ * Attach both directions to a veth, and retry directions that failed before.
+ * A veth that was re-created with the same name gets attached again.
+ */
+func attach(objs *firewall_containerObjects, attached map[string]*attachment, name string, ifindex int) {
+	a := attached[name]
+	// same name, new interface: the old links went away with the old interface
+	if a != nil && a.ifindex != ifindex {
+		a.Close()
+		a = nil
+		fmt.Printf("<< %q was re-created, attaching again\n", name)
+	}
+	if a == nil {
+		a = &attachment{ifindex: ifindex}
+	}
+
+	var err error
+	if a.ingress == nil {
+		if a.ingress, err = a.attachDirection(objs, ruleDirOut); err != nil {
+			log.Printf("Failed to attach to %q ingress: %v", name, err)
+		} else {
+			fmt.Printf(">> attached eBPF TC to %q ingress (%s)\n", name, a.ingress.mechanism)
+		}
+	}
+	if a.egress == nil {
+		if a.egress, err = a.attachDirection(objs, ruleDirIn); err != nil {
+			log.Printf("Failed to attach to %q egress: %v", name, err)
+		} else {
+			fmt.Printf(">> attached eBPF TC to %q egress (%s)\n", name, a.egress.mechanism)
+		}
+	}
+
+	// record the attachment handles so they can be detached later if necessary
+	if a.ingress != nil || a.egress != nil {
+		attached[name] = a
+	} else {
+		delete(attached, name)
+	}
+}
+
+func detach(attached map[string]*attachment, name string) {
+	if a, ok := attached[name]; ok {
+		mechanisms := a.mechanisms()
+		a.Close()
+		delete(attached, name)
+		fmt.Printf("<< detached eBPF TC from %q (%s)\n", name, mechanisms)
+	}
+}
+
+/*
+ * Handle a netlink link event: attach to a container veth as soon as it is plugged into a docker
+ * bridge, detach as soon as it is gone or unplugged. Returns whether the attachments may have
+ * changed, i.e. the rules have to be applied.
+ */
+func handleLinkUpdate(objs *firewall_containerObjects, attached map[string]*attachment, u netlink.LinkUpdate) bool {
+	if u.Link == nil {
+		return false
+	}
+	name := u.Attrs().Name
+	_, known := attached[name]
+	switch {
+	case u.Header.Type == unix.RTM_NEWLINK && isContainerVeth(u.Link):
+		attach(objs, attached, name, u.Attrs().Index)
+	case known:
+		// deleted, or no longer plugged into a docker bridge
+		detach(attached, name)
+	default:
+		return false
+	}
+	return true
+}
+
+/*
+ * Compare the attachments with the interfaces that exist, in case a netlink event got lost
+ * (or there is no subscription).
+ * - Attaches to container veths that are not attached yet
+ * - Detaches from veths that are gone
+ */
+func syncLinks(objs *firewall_containerObjects, attached map[string]*attachment) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Printf("Failed to list links: %v", err)
 		return
 	}
+	present := make(map[string]bool, len(links))
+	for _, l := range links {
+		if !isContainerVeth(l) {
+			continue
+		}
+		name := l.Attrs().Name
+		present[name] = true
+		if a, ok := attached[name]; !ok || a.ifindex != l.Attrs().Index || a.ingress == nil || a.egress == nil {
+			attach(objs, attached, name, l.Attrs().Index)
+		}
+	}
+	for name := range attached {
+		if !present[name] {
+			detach(attached, name)
+		}
+	}
+}
+
+/*
+ * From what the manager recorded in the filtered_logs database:
+ * veth name -> id of its container, and container id -> its current addresses
+ */
+func containerVeths(db *sql.DB) (map[string]string, map[string][]netip.Addr, error) {
+	// fetch the container id, the comma-seperated 'veth' column and the comma-seperated 'ips' column
+	rows, err := db.Query(`SELECT container_id, veth, COALESCE(ips, '') FROM filtered_logs WHERE action != 'destroy'`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("querying filtered_logs: %w", err)
+	}
 	defer rows.Close()
 
-	// map with desired veth interfaces as keys and empty structs (0 value) as values
-	desired := make(map[string]struct{})
-	// iterate through the veth column
+	veths := make(map[string]string)
+	ips := make(map[string][]netip.Addr)
 	for rows.Next() {
-		var csv string
-		if err := rows.Scan(&csv); err != nil {
+		var containerID, csv, ipCSV string
+		if err := rows.Scan(&containerID, &csv, &ipCSV); err != nil {
 			log.Printf("Warning: scan error: %v", err)
 			continue
 		}
+		for _, ip := range strings.Split(ipCSV, ",") {
+			if addr, err := netip.ParseAddr(strings.TrimSpace(ip)); err == nil {
+				ips[containerID] = append(ips[containerID], addr)
+			}
+		}
 		// split comma-separated veth names ("veth0,veth1") into individual names
 		for _, name := range strings.Split(csv, ",") {
 			name = strings.TrimSpace(name)
 			if name != "" {
-				desired[name] = struct{}{}
+				veths[name] = containerID
 			}
 		}
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("Warning: rows iteration error: %v", err)
+	return veths, ips, rows.Err()
+}
+
+/*
+ * Write the rules of every attached direction into map_port_rules and the segments between
+ * the containers into map_segments.
+ * The default rule set is written as well, a veth that has no rules of its own yet (not
+ * mapped to its container, or attached since the last call) is filtered by it from its
+ * first packet on.
+ */
+func applyRules(db *sql.DB, objs *firewall_containerObjects, attached map[string]*attachment) {
+	veths, ips, err := containerVeths(db)
+	if err != nil {
+		// keep the rules in place, an unmapped container would fall back to the default rule set
+		log.Printf("Error reading container veths: %v", err)
+		return
+	}
+
+	// the container behind every attached direction, the rules are keyed by ifindex and direction
+	ifaces := make(map[rulesKey]string, 2*len(attached)+2)
+	ifaces[rulesKey{Ifindex: rulesDefaultIfindex, Direction: uint32(ruleDirOut)}] = ""
+	ifaces[rulesKey{Ifindex: rulesDefaultIfindex, Direction: uint32(ruleDirIn)}] = ""
+	for name, a := range attached {
+		if a.ingress != nil {
+			ifaces[rulesKey{Ifindex: uint32(a.ifindex), Direction: uint32(ruleDirOut)}] = veths[name]
+		}
+		if a.egress != nil {
+			ifaces[rulesKey{Ifindex: uint32(a.ifindex), Direction: uint32(ruleDirIn)}] = veths[name]
+		}
+	}
+
+	// rules are re-read on every update, so changes to the configuration or labels apply live
+	cfg, err := loadRulesConfig(rulesConfigPath)
+	if err != nil {
+		log.Printf("Could not load firewall rules, using built-in rules: %v", err)
+		cfg = defaultRulesConfig()
 	}
+	containerIDs := make(map[string]struct{})
+	for _, id := range veths {
+		containerIDs[id] = struct{}{}
+	}
+	metas := inspectContainers(containerIDs)
+
+	updateRules(cfg, metas, objs.MapPortRules, objs.MapConntrack, objs.MapCounters, ifaces)
 
-	//iterate through the desired veth names map
-	for name := range desired {
-		// check if that veth name has already been attached to
-		if _, ok := attached[name]; ok {
+	// the interfaces and addresses of every attached container, the segments are compiled from them
+	members := make(map[string]*segmentMember)
+	for name, a := range attached {
+		id, ok := veths[name]
+		if !ok {
 			continue
 		}
-		// get numeric interface based on veth interface
-		// To attach a TC hook, you must tell the kernel which interface by its numeric index, not its string name.
-		iface, err := net.InterfaceByName(name)
-		if err != nil {
-			log.Printf("Could not find interface %q: %v", name, err)
+		m := members[id]
+		if m == nil {
+			m = &segmentMember{ID: id, Meta: metas[id], IPs: ips[id]}
+			members[id] = m
+		}
+		m.Ifindexes = append(m.Ifindexes, uint32(a.ifindex))
+	}
+	updateSegments(cfg, members, objs.MapSegments, objs.MapConntrack)
+}
+
+/*
+ * Remove pinned maps whose layout no longer matches the compiled program, e.g. map_conntrack
+ * after its key grew. Loading would fail on them, so they are created and pinned again
+ * (the tracked connections and counters they held are lost).
+ */
+func removeIncompatiblePins(pinPath string) error {
+	spec, err := loadFirewall_containerSpec()
+	if err != nil {
+		return err
+	}
+	for name, ms := range spec.Maps {
+		if ms.Pinning != ebpf.PinByName {
+			continue
+		}
+		file := filepath.Join(pinPath, name)
+		m, err := ebpf.LoadPinnedMap(file, &ebpf.LoadPinOptions{ReadOnly: true})
+		if errors.Is(err, os.ErrNotExist) {
 			continue
 		}
-		// attach the firewall at the TC ingress hook on this index.
-		lnk, err := link.AttachTCX(link.TCXOptions{
-			Program:   prog,
-			Interface: iface.Index,
-			Attach:    ebpf.AttachTCXIngress,
-		})
 		if err != nil {
-			log.Printf("Failed to attach to %q: %v", name, err)
+			return fmt.Errorf("opening pinned %s: %w", name, err)
+		}
+		compatible := m.Type() == ms.Type && m.KeySize() == ms.KeySize &&
+			m.ValueSize() == ms.ValueSize && m.MaxEntries() == ms.MaxEntries
+		m.Close()
+		if compatible {
 			continue
 		}
-		// record the attachment handle so it can be detached later if necessary
-		attached[name] = lnk
-		fmt.Printf(">> attached eBPF TC to %q ingress\n", name)
-	}
-
-	// detach from interfaces no longer desired
-	for name, lnk := range attached {
-		if _, ok := desired[name]; !ok {
-			lnk.Close()
-			delete(attached, name)
-			fmt.Printf("<< detached eBPF TC from %q\n", name)
+		log.Printf("Pinned %s has an old layout, creating it again", name)
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("removing pinned %s: %w", name, err)
 		}
 	}
+	return nil
 }
 
 func main() {
@@ -95,13 +302,6 @@ func main() {
 		log.Fatalf("removing memlock rlimit: %v", err)
 	}
 
-	// Load the compiled eBPF ELF and load it into the kernel.
-	var objs firewall_containerObjects
-	if err := loadFirewall_containerObjects(&objs, nil); err != nil {
-		log.Fatalf("loading eBPF objects: %v", err)
-	}
-	defer objs.Close()
-
 	// open filtered_logs database
 	db, err := sql.Open("sqlite", "../manager/data/filtered_logs.db")
 	if err != nil {
@@ -109,12 +309,77 @@ func main() {
 	}
 	defer db.Close()
 
+	cidrFiles := flag.String("cidr-lists", cidrListsPath, "comma separated files with allow and deny lists of addresses")
+	metrics := flag.String("metrics", metricsAddr, "address of the prometheus metrics endpoint, empty to disable")
+	flag.Parse()
+
+	// firewall_container conntrack list|flush [container] works on the running firewall
+	if flag.Arg(0) == "conntrack" {
+		if err := runConntrackCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// firewall_container counters [container] prints the counters of the running firewall
+	if flag.Arg(0) == "counters" {
+		if err := runCountersCommand(db, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// the conntrack and counters maps are pinned, like the maps of the LSM modules
+	pinPath := "/sys/fs/bpf/maps"
+	if err := os.MkdirAll(pinPath, os.ModePerm); err != nil {
+		log.Fatalf("failed to create bpf fs subpath: %+v", err)
+	}
+
+	if err := removeIncompatiblePins(pinPath); err != nil {
+		log.Fatalf("checking pinned maps: %v", err)
+	}
+
+	// Load the compiled eBPF ELF and load it into the kernel.
+	var objs firewall_containerObjects
+	if err := loadFirewall_containerObjects(&objs, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: pinPath,
+		},
+	}); err != nil {
+		log.Fatalf("loading eBPF objects: %v", err)
+	}
+	defer objs.Close()
+
 	// create map to check wether the containers (and its veth) are still active
-	attached := make(map[string]link.Link)
+	attached := make(map[string]*attachment)
+
+	// address lists apply to every container, they are reloaded when a file changes
+	lists := cidr_lists.New(objs.MapCidrLists, strings.Split(*cidrFiles, ","))
+	lists.ReloadIfChanged()
+
+	/*
+	 * veths are attached on netlink events as soon as they appear,
+	 * the database only maps them to their containers
+	 */
+	updates, done, err := subscribeLinks()
+	if err != nil {
+		log.Printf("Failed to subscribe to link events, polling instead: %v", err)
+	}
+	defer func() {
+		if done != nil {
+			close(done)
+		}
+	}()
+	// the default rule set is in place before the first veth is attached
+	applyRules(db, &objs, attached)
+	syncLinks(&objs, attached)
+	applyRules(db, &objs, attached)
 
-	updateAttachments(db, objs.TcIngressProgram, attached)
+	if *metrics != "" {
+		go serveMetrics(*metrics, db, objs.MapCounters)
+	}
 
-	// set up a ticker to poll the database every 5s
+	// set up a ticker to re-read the container mapping and rules every 5s
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -126,11 +391,37 @@ func main() {
 	log.Printf("                 successfully loaded firewall_container")
 	log.Printf("<<<<--------------------------------------------------------->>>>")
 
+	// fires linkSettleDelay after the first link event that was not applied yet
+	var settle <-chan time.Time
+
 	for {
 		select {
+		case u, ok := <-updates:
+			if !ok {
+				// the subscription ends on errors, the ticker subscribes again
+				log.Printf("Link event subscription closed, polling until it is back")
+				updates, done = nil, nil
+				continue
+			}
+			if handleLinkUpdate(&objs, attached, u) && settle == nil {
+				settle = time.After(linkSettleDelay)
+			}
+
+		case <-settle:
+			settle = nil
+			applyRules(db, &objs, attached)
+
 		case <-ticker.C:
-			// re-sync attachments to database changes
-			updateAttachments(db, objs.TcIngressProgram, attached)
+			if updates == nil {
+				if updates, done, err = subscribeLinks(); err != nil {
+					log.Printf("Failed to subscribe to link events: %v", err)
+				}
+			}
+			// catch up on lost events and on mapping changes in the database
+			syncLinks(&objs, attached)
+			applyRules(db, &objs, attached)
+			expireFlows(objs.MapConntrack)
+			lists.ReloadIfChanged()
 
 		case <-sig:
 			// detach all before exit
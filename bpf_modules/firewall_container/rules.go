@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"cidr_lists"
+
+	"github.com/cilium/ebpf"
+	"github.com/docker/docker/client"
+)
+
+// the values have to match the defines in firewall_container.c
+const (
+	maxPortRules = 16
+
+	ruleDirOut uint8 = 1
+	ruleDirIn  uint8 = 2
+
+	ruleActionAllow uint8 = 1
+	ruleActionDeny  uint8 = 2
+)
+
+// default location of the rule configuration, relative to the working directory (john_wick)
+const rulesConfigPath = "firewall_rules.json"
+
+/*
+ * a container can pick its rule set directly with this label, e.g. honey-buzzard.firewall=web,
+ * or one per direction with honey-buzzard.firewall.in and honey-buzzard.firewall.out
+ */
+const ruleSetLabel = "honey-buzzard.firewall"
+
+var directionLabels = map[uint8]string{
+	ruleDirOut: "out",
+	ruleDirIn:  "in",
+}
+var protocolNumbers = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+// icmp rules match types and codes instead of ports
+func isICMP(proto uint8) bool {
+	return proto == protocolNumbers["icmp"] || proto == protocolNumbers["icmpv6"]
+}
+
+var directionNames = map[string]uint8{
+	"out":  ruleDirOut,
+	"in":   ruleDirIn,
+	"both": ruleDirOut | ruleDirIn,
+}
+
+var actionNames = map[string]uint8{
+	"allow": ruleActionAllow,
+	"deny":  ruleActionDeny,
+}
+
+/*
+ * key and value of map_port_rules
+ * the layout has to match struct rules_key, struct port_rule and struct port_rules in firewall_container.c
+ */
+type rulesKey struct {
+	Ifindex   uint32
+	Direction uint32
+}
+
+// the entries of the default rule set, RULES_DEFAULT_IFINDEX in firewall_container.c
+const rulesDefaultIfindex uint32 = 0
+
+type portRule struct {
+	Addr      [16]byte
+	SrcFirst  uint16
+	SrcLast   uint16
+	DstFirst  uint16
+	DstLast   uint16
+	Proto     uint8
+	Direction uint8
+	Action    uint8
+	PrefixLen uint8
+}
+
+type portRules struct {
+	Count         uint32
+	DefaultAction uint32
+	UnknownAction uint32
+	Rules         [maxPortRules]portRule
+}
+
+/*
+ * A single rule of a rule set.
+ * CIDR is the address or network of the other side, IPv4 or IPv6 ("10.0.0.0/8", "2001:db8::1"),
+ * empty matches every address.
+ * SrcPorts and DstPorts are a port ("80") or a range ("8000-8100"), empty matches every port.
+ * ICMPType and ICMPCode are used instead of ports by icmp and icmpv6 rules, also a single value
+ * or a range, empty matches every type or code.
+ * Direction is seen from the container: "out" (sent by it), "in" (sent to it) or "both".
+ */
+type RuleConfig struct {
+	Protocol  string `json:"protocol"`
+	CIDR      string `json:"cidr,omitempty"`
+	SrcPorts  string `json:"src_ports,omitempty"`
+	DstPorts  string `json:"dst_ports,omitempty"`
+	ICMPType  string `json:"icmp_type,omitempty"`
+	ICMPCode  string `json:"icmp_code,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	Action    string `json:"action"`
+}
+
+// the rules of a container, checked in order, the first match decides
+type RuleSet struct {
+	// action for tcp, udp and icmp packets no rule matches, "allow" or "deny"
+	DefaultAction string `json:"default_action"`
+	// action for every other ip protocol, "allow" (the default) or "deny"
+	UnknownAction string       `json:"unknown_action,omitempty"`
+	Rules         []RuleConfig `json:"rules"`
+}
+
+/*
+ * Every container has a rule set per direction: "out" is checked on what the container sends,
+ * "in" on what is sent to it. Replies of an allowed connection pass either way.
+ * Segments decide between containers instead of the rule sets, see segments.go.
+ */
+type RulesConfig struct {
+	// rule set of containers without label or entry in Containers, for both directions
+	Default    string             `json:"default"`
+	RuleSets   map[string]RuleSet `json:"rule_sets"`
+	Containers []ContainerRuleSet `json:"containers,omitempty"`
+	Segments   []Segment          `json:"segments,omitempty"`
+}
+
+/*
+ * assigns a rule set to every container whose name matches Name (glob pattern, e.g. "web-*")
+ * RuleSet is used for both directions, InRuleSet and OutRuleSet replace it for one direction
+ */
+type ContainerRuleSet struct {
+	Name       string `json:"name"`
+	RuleSet    string `json:"rule_set,omitempty"`
+	InRuleSet  string `json:"in_rule_set,omitempty"`
+	OutRuleSet string `json:"out_rule_set,omitempty"`
+}
+
+// the rule set of the entry for a direction, empty if it has none
+func (c ContainerRuleSet) forDirection(direction uint8) string {
+	if direction == ruleDirIn && c.InRuleSet != "" {
+		return c.InRuleSet
+	}
+	if direction == ruleDirOut && c.OutRuleSet != "" {
+		return c.OutRuleSet
+	}
+	return c.RuleSet
+}
+
+/*
+ * built-in rules, used when no configuration file exists
+ * legacy is the rule every container had before rules were configurable:
+ * only tcp 1234 -> 80 and back, every other protocol passes
+ */
+func defaultRulesConfig() *RulesConfig {
+	return &RulesConfig{
+		Default: "legacy",
+		RuleSets: map[string]RuleSet{
+			"legacy": {
+				DefaultAction: "deny",
+				Rules: []RuleConfig{
+					{Protocol: "tcp", SrcPorts: "1234", DstPorts: "80", Direction: "both", Action: "allow"},
+					{Protocol: "tcp", SrcPorts: "80", DstPorts: "1234", Direction: "both", Action: "allow"},
+					{Protocol: "udp", Direction: "both", Action: "allow"},
+					{Protocol: "icmp", Direction: "both", Action: "allow"},
+					{Protocol: "icmpv6", Direction: "both", Action: "allow"},
+				},
+			},
+		},
+	}
+}
+
+/*
+ * Read the rule configuration from a JSON file.
+ * If the file does not exist, the built-in rules are returned.
+ */
+func loadRulesConfig(file string) (*RulesConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return defaultRulesConfig(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+
+	var cfg RulesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if _, ok := cfg.RuleSets[cfg.Default]; !ok {
+		return nil, fmt.Errorf("%s: default rule set %q is not defined", file, cfg.Default)
+	}
+	// compile every rule set once, so a broken rule is reported right away
+	for name, set := range cfg.RuleSets {
+		if _, err := set.compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule set %q: %w", file, name, err)
+		}
+	}
+	for i, seg := range cfg.Segments {
+		if _, err := seg.compile(); err != nil {
+			return nil, fmt.Errorf("%s: segment %d: %w", file, i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// parse "80" or "8000-8100", an empty string is every port
+func parsePorts(ports string) (uint16, uint16, error) {
+	return parseRange(ports, 16, "ports")
+}
+
+// parse an icmp type or code, "8" or "0-255", an empty string is every value
+func parseICMP(value, what string) (uint16, uint16, error) {
+	return parseRange(value, 8, what)
+}
+
+func parseRange(value string, bitSize int, what string) (uint16, uint16, error) {
+	if value == "" {
+		return 0, uint16(1<<bitSize - 1), nil
+	}
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		last = first
+	}
+	f, err1 := strconv.ParseUint(first, 10, bitSize)
+	l, err2 := strconv.ParseUint(last, 10, bitSize)
+	if err1 != nil || err2 != nil || f > l {
+		return 0, 0, fmt.Errorf("invalid %s %q", what, value)
+	}
+	return uint16(f), uint16(l), nil
+}
+
+/*
+ * parse an address or a network, an empty string is every address
+ * IPv4 is stored IPv4-mapped, like the addresses the bpf program compares it with
+ */
+func parseCIDR(cidr string) ([16]byte, uint8, error) {
+	if cidr == "" {
+		return [16]byte{}, 0, nil
+	}
+	prefix, err := cidr_lists.ParsePrefix(cidr)
+	if err != nil {
+		return [16]byte{}, 0, err
+	}
+	return prefix.Addr().As16(), uint8(prefix.Bits()), nil
+}
+
+// translate a rule set into the value of map_port_rules
+func (s RuleSet) compile() (portRules, error) {
+	var out portRules
+
+	action, ok := actionNames[s.DefaultAction]
+	if !ok {
+		return out, fmt.Errorf("unknown default action %q", s.DefaultAction)
+	}
+	out.DefaultAction = uint32(action)
+
+	unknown := s.UnknownAction
+	if unknown == "" {
+		unknown = "allow"
+	}
+	if action, ok = actionNames[unknown]; !ok {
+		return out, fmt.Errorf("invalid unknown_action %q", s.UnknownAction)
+	}
+	out.UnknownAction = uint32(action)
+
+	if len(s.Rules) > maxPortRules {
+		return out, fmt.Errorf("%d rules configured, at most %d are supported", len(s.Rules), maxPortRules)
+	}
+	for i, r := range s.Rules {
+		var rule portRule
+		var err error
+		if rule.Proto, ok = protocolNumbers[r.Protocol]; !ok {
+			return out, fmt.Errorf("rule %d: unknown protocol %q", i, r.Protocol)
+		}
+		direction := r.Direction
+		if direction == "" {
+			direction = "out"
+		}
+		if rule.Direction, ok = directionNames[direction]; !ok {
+			return out, fmt.Errorf("rule %d: unknown direction %q", i, r.Direction)
+		}
+		if rule.Action, ok = actionNames[r.Action]; !ok {
+			return out, fmt.Errorf("rule %d: unknown action %q", i, r.Action)
+		}
+		if rule.Addr, rule.PrefixLen, err = parseCIDR(r.CIDR); err != nil {
+			return out, fmt.Errorf("rule %d: %w", i, err)
+		}
+		// the bpf program compares icmp type and code in the port fields
+		if isICMP(rule.Proto) {
+			if r.SrcPorts != "" || r.DstPorts != "" {
+				return out, fmt.Errorf("rule %d: %s has no ports, use icmp_type and icmp_code", i, r.Protocol)
+			}
+			if rule.SrcFirst, rule.SrcLast, err = parseICMP(r.ICMPType, "icmp type"); err != nil {
+				return out, fmt.Errorf("rule %d: %w", i, err)
+			}
+			if rule.DstFirst, rule.DstLast, err = parseICMP(r.ICMPCode, "icmp code"); err != nil {
+				return out, fmt.Errorf("rule %d: %w", i, err)
+			}
+		} else {
+			if r.ICMPType != "" || r.ICMPCode != "" {
+				return out, fmt.Errorf("rule %d: icmp_type and icmp_code only apply to icmp and icmpv6", i)
+			}
+			if rule.SrcFirst, rule.SrcLast, err = parsePorts(r.SrcPorts); err != nil {
+				return out, fmt.Errorf("rule %d: %w", i, err)
+			}
+			if rule.DstFirst, rule.DstLast, err = parsePorts(r.DstPorts); err != nil {
+				return out, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+		out.Rules[i] = rule
+	}
+	out.Count = uint32(len(s.Rules))
+	return out, nil
+}
+
+/*
+ * Pick the rule set of a container for a direction:
+ * 1. the honey-buzzard.firewall.in / honey-buzzard.firewall.out label
+ * 2. the honey-buzzard.firewall label
+ * 3. the first entry of Containers whose pattern matches the container's name
+ * 4. the default rule set
+ */
+func (c *RulesConfig) resolve(name string, labels map[string]string, direction uint8) (string, RuleSet) {
+	for _, label := range []string{ruleSetLabel + "." + directionLabels[direction], ruleSetLabel} {
+		set, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if rs, ok := c.RuleSets[set]; ok {
+			return set, rs
+		}
+		log.Printf("Container %s uses undefined rule set %q, using %q", name, set, c.Default)
+		return c.Default, c.RuleSets[c.Default]
+	}
+	for _, ct := range c.Containers {
+		if ok, err := path.Match(ct.Name, name); err == nil && ok {
+			set := ct.forDirection(direction)
+			if rs, ok := c.RuleSets[set]; ok {
+				return set, rs
+			}
+		}
+	}
+	return c.Default, c.RuleSets[c.Default]
+}
+
+// name and labels of a container, used to pick its rule set
+type containerMeta struct {
+	Name   string
+	Labels map[string]string
+}
+
+func inspectContainers(containerIDs map[string]struct{}) map[string]containerMeta {
+	metas := make(map[string]containerMeta, len(containerIDs))
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		log.Printf("Docker client error: %v", err)
+		return metas
+	}
+	defer cli.Close()
+
+	ctx := context.Background()
+	for id := range containerIDs {
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			log.Printf("Failed to inspect container %.12s: %v", id, err)
+			continue
+		}
+		meta := containerMeta{Name: strings.TrimPrefix(inspect.Name, "/")}
+		if inspect.Config != nil {
+			meta.Labels = inspect.Config.Labels
+		}
+		metas[id] = meta
+	}
+	return metas
+}
+
+/*
+ * Write the rules of every attached interface and direction into map_port_rules and remove
+ * the entries of directions that are no longer attached. ifaces maps every attached direction
+ * of a veth to the id of its container, empty if it is not known yet, and rulesDefaultIfindex
+ * to the default rule set.
+ * Tracked connections of a container whose rules changed are flushed, so the new rules also
+ * apply to connections that are already open. Its rule counters start over, as a rule index
+ * may now stand for another rule.
+ */
+func updateRules(cfg *RulesConfig, metas map[string]containerMeta, rulesMap, conntrackMap, countersMap *ebpf.Map, ifaces map[rulesKey]string) {
+	changed := make(map[uint32]bool)
+	// counters to reset, true keeps those that do not belong to a port rule
+	resets := make(map[rulesKey]bool)
+	for key, id := range ifaces {
+		meta := metas[id]
+		direction := uint8(key.Direction)
+		name, set := cfg.resolve(meta.Name, meta.Labels, direction)
+		want, err := set.compile()
+		if err != nil {
+			log.Printf("Rule set %q of container %.12s: %v", name, id, err)
+			continue
+		}
+
+		var current portRules
+		if err := rulesMap.Lookup(key, &current); err == nil && current == want {
+			continue
+		}
+		if err := rulesMap.Update(key, want, ebpf.UpdateAny); err != nil {
+			log.Printf("Failed to write %s rules of container %.12s: %v", directionLabels[direction], id, err)
+			continue
+		}
+		if key.Ifindex == rulesDefaultIfindex {
+			log.Printf("Applied rule set %q as default (%s)", name, directionLabels[direction])
+		} else {
+			log.Printf("Applied rule set %q to container %.12s (ifindex %d, %s)", name, id, key.Ifindex, directionLabels[direction])
+		}
+		changed[key.Ifindex] = true
+		resets[key] = true
+	}
+
+	// forget directions that are no longer attached
+	var key rulesKey
+	var rules portRules
+	var stale []rulesKey
+	iter := rulesMap.Iterate()
+	for iter.Next(&key, &rules) {
+		if _, ok := ifaces[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	for _, key := range stale {
+		if err := rulesMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete rules of ifindex %d: %v", key.Ifindex, err)
+		}
+		changed[key.Ifindex] = true
+		resets[key] = false
+	}
+	resetCounters(countersMap, resets)
+
+	if len(changed) == 0 {
+		return
+	}
+	if _, err := flushFlows(conntrackMap, changed); err != nil {
+		log.Printf("Failed to flush tracked connections: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"path"
+
+	"github.com/cilium/ebpf"
+)
+
+// the value has to match MAX_SEGMENT_PORTS in firewall_container.c
+const maxSegmentPorts = 8
+
+/*
+ * key and value of map_segments
+ * the layout has to match struct segment_key, struct segment_port and struct segment_rule in firewall_container.c
+ */
+type segmentKey struct {
+	Ifindex   uint32
+	Direction uint32
+	Addr      [16]byte
+}
+
+type segmentPort struct {
+	First uint16
+	Last  uint16
+	Proto uint8
+	_     [3]byte
+}
+
+type segmentRule struct {
+	Count uint32
+	Ports [maxSegmentPorts]segmentPort
+}
+
+/*
+ * Picks containers by name (glob pattern, e.g. "web-*") and labels, all given fields have to match.
+ */
+type ContainerSelector struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (s ContainerSelector) matches(meta containerMeta) bool {
+	if s.Name != "" {
+		if ok, err := path.Match(s.Name, meta.Name); err != nil || !ok {
+			return false
+		}
+	}
+	for key, value := range s.Labels {
+		if meta.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * A segment allows containers picked by From to reach containers picked by To on Protocol and
+ * Ports (destination ports, empty is every port), e.g. service=web may talk to service=db on 5432.
+ * A container picked by the To of any segment is segmented: other containers reach it only
+ * through segments, nothing else. Between containers the segments replace the rule sets,
+ * traffic to and from everything outside the containers still goes through the rule sets.
+ */
+type Segment struct {
+	From     ContainerSelector `json:"from"`
+	To       ContainerSelector `json:"to"`
+	Protocol string            `json:"protocol"`
+	Ports    string            `json:"ports,omitempty"`
+}
+
+func (s Segment) compile() (segmentPort, error) {
+	var out segmentPort
+	var err error
+	if s.From.Name == "" && len(s.From.Labels) == 0 {
+		return out, errors.New("from picks no container, set name or labels")
+	}
+	if s.To.Name == "" && len(s.To.Labels) == 0 {
+		return out, errors.New("to picks no container, set name or labels")
+	}
+	var ok bool
+	if out.Proto, ok = protocolNumbers[s.Protocol]; !ok {
+		return out, fmt.Errorf("unknown protocol %q", s.Protocol)
+	}
+	if isICMP(out.Proto) && s.Ports != "" {
+		return out, fmt.Errorf("%s has no ports", s.Protocol)
+	}
+	if out.First, out.Last, err = parsePorts(s.Ports); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// a container that takes part in segments: its interfaces and its current addresses
+type segmentMember struct {
+	ID        string
+	Meta      containerMeta
+	IPs       []netip.Addr
+	Ifindexes []uint32
+}
+
+/*
+ * Turn the segments into the content of map_segments.
+ * For every segmented container and every other container, the ports the other one may use
+ * are written twice: at the segmented container's interfaces for the other's addresses (in),
+ * and at the other's interfaces for the segmented container's addresses (out).
+ * A pair without allowed ports gets an entry with no ports, so its traffic is dropped.
+ */
+func compileSegments(cfg *RulesConfig, members map[string]*segmentMember) map[segmentKey]segmentRule {
+	type pair struct{ from, to string }
+	allowed := make(map[pair][]segmentPort)
+	segmented := make(map[string]bool)
+
+	for i, seg := range cfg.Segments {
+		port, err := seg.compile()
+		if err != nil {
+			log.Printf("Segment %d: %v", i, err)
+			continue
+		}
+		for _, dst := range members {
+			if !seg.To.matches(dst.Meta) {
+				continue
+			}
+			segmented[dst.ID] = true
+			for _, src := range members {
+				if src.ID != dst.ID && seg.From.matches(src.Meta) {
+					p := pair{src.ID, dst.ID}
+					allowed[p] = append(allowed[p], port)
+				}
+			}
+		}
+	}
+
+	out := make(map[segmentKey]segmentRule)
+	for dstID := range segmented {
+		dst := members[dstID]
+		for _, src := range members {
+			if src.ID == dstID {
+				continue
+			}
+			var rule segmentRule
+			ports := allowed[pair{src.ID, dstID}]
+			if len(ports) > maxSegmentPorts {
+				log.Printf("Segments from %s to %s: %d port ranges, only the first %d are used",
+					src.Meta.Name, dst.Meta.Name, len(ports), maxSegmentPorts)
+				ports = ports[:maxSegmentPorts]
+			}
+			rule.Count = uint32(copy(rule.Ports[:], ports))
+
+			for _, ip := range src.IPs {
+				for _, ifindex := range dst.Ifindexes {
+					out[segmentKey{Ifindex: ifindex, Direction: uint32(ruleDirIn), Addr: ip.As16()}] = rule
+				}
+			}
+			for _, ip := range dst.IPs {
+				for _, ifindex := range src.Ifindexes {
+					out[segmentKey{Ifindex: ifindex, Direction: uint32(ruleDirOut), Addr: ip.As16()}] = rule
+				}
+			}
+		}
+	}
+	return out
+}
+
+/*
+ * Write the segments into map_segments and remove entries that no longer apply, e.g. the
+ * old addresses of a container that was restarted. Tracked connections of the interfaces
+ * whose entries changed are flushed, so the segments also apply to open connections.
+ */
+func updateSegments(cfg *RulesConfig, members map[string]*segmentMember, segmentsMap, conntrackMap *ebpf.Map) {
+	want := compileSegments(cfg, members)
+	changed := make(map[uint32]bool)
+
+	var key segmentKey
+	var rule segmentRule
+	var stale []segmentKey
+	iter := segmentsMap.Iterate()
+	for iter.Next(&key, &rule) {
+		if w, ok := want[key]; !ok {
+			stale = append(stale, key)
+		} else if w == rule {
+			delete(want, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Could not read segments: %v", err)
+		return
+	}
+
+	for _, key := range stale {
+		if err := segmentsMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete segment of ifindex %d: %v", key.Ifindex, err)
+		}
+		changed[key.Ifindex] = true
+	}
+	// what is left in want is new or different
+	for key, rule := range want {
+		if err := segmentsMap.Update(key, rule, ebpf.UpdateAny); err != nil {
+			log.Printf("Failed to write segment of ifindex %d: %v", key.Ifindex, err)
+			continue
+		}
+		changed[key.Ifindex] = true
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+	log.Printf("Updated segments: %d written, %d removed", len(want), len(stale))
+	if _, err := flushFlows(conntrackMap, changed); err != nil {
+		log.Printf("Failed to flush tracked connections: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// how a program is attached to an interface
+const (
+	// TCX links, kernel 6.6 and newer
+	mechanismTCX = "tcx"
+	// a direct-action bpf filter on a clsact qdisc, for older kernels
+	mechanismClsact = "clsact"
+)
+
+// handle and priority of our clsact filters, a filter left over by an earlier run gets replaced
+const (
+	clsactFilterHandle   = 1
+	clsactFilterPriority = 1
+)
+
+/*
+ * set once TCX turned out to be unsupported, every further interface goes
+ * straight to clsact instead of failing TCX again
+ */
+var tcxUnsupported bool
+
+// a program attached to one direction of an interface, through TCX or clsact
+type tcHook struct {
+	mechanism string
+	tcx       link.Link
+	filter    *netlink.BpfFilter
+}
+
+func (h *tcHook) Close() error {
+	if h.tcx != nil {
+		return h.tcx.Close()
+	}
+	// the filter is gone already if the interface is
+	if err := netlink.FilterDel(h.filter); err != nil && !errors.Is(err, unix.ENODEV) && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+/*
+ * the hooks of the firewall on a veth, one per direction
+ * each direction is attached on its own, a direction that failed is retried on the next update
+ */
+type attachment struct {
+	ifindex int
+	// tc_ingress_program at the ingress of the host side: what the container sends
+	ingress *tcHook
+	// tc_egress_program at the egress of the host side: what is sent to the container
+	egress *tcHook
+	// the clsact qdisc was added by us and is removed with the last filter
+	ownQdisc bool
+}
+
+func (a *attachment) Close() {
+	for _, h := range []**tcHook{&a.ingress, &a.egress} {
+		if *h == nil {
+			continue
+		}
+		if err := (*h).Close(); err != nil {
+			log.Printf("Failed to detach %s hook from ifindex %d: %v", (*h).mechanism, a.ifindex, err)
+		}
+		*h = nil
+	}
+	if a.ownQdisc {
+		if err := netlink.QdiscDel(clsactQdisc(a.ifindex)); err != nil && !errors.Is(err, unix.ENODEV) && !errors.Is(err, unix.ENOENT) {
+			log.Printf("Failed to remove clsact qdisc of ifindex %d: %v", a.ifindex, err)
+		}
+		a.ownQdisc = false
+	}
+}
+
+// the mechanisms of both directions, for the log
+func (a *attachment) mechanisms() string {
+	name := func(h *tcHook) string {
+		if h == nil {
+			return "-"
+		}
+		return h.mechanism
+	}
+	return fmt.Sprintf("ingress=%s egress=%s", name(a.ingress), name(a.egress))
+}
+
+/*
+ * Attach the program of one direction (seen from the container) to the interface of a.
+ * TCX is tried first, if it fails (kernels before 6.6) the program is attached as a clsact filter.
+ */
+func (a *attachment) attachDirection(objs *firewall_containerObjects, direction uint8) (*tcHook, error) {
+	prog, tcxAttach, parent := objs.TcIngressProgram, ebpf.AttachTCXIngress, uint32(netlink.HANDLE_MIN_INGRESS)
+	if direction == ruleDirIn {
+		prog, tcxAttach, parent = objs.TcEgressProgram, ebpf.AttachTCXEgress, uint32(netlink.HANDLE_MIN_EGRESS)
+	}
+
+	if !tcxUnsupported {
+		lnk, err := link.AttachTCX(link.TCXOptions{
+			Program:   prog,
+			Interface: a.ifindex,
+			Attach:    tcxAttach,
+		})
+		if err == nil {
+			return &tcHook{mechanism: mechanismTCX, tcx: lnk}, nil
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			log.Printf("TCX is not supported by this kernel, using clsact qdiscs")
+			tcxUnsupported = true
+		} else {
+			log.Printf("TCX attach to ifindex %d failed, trying clsact: %v", a.ifindex, err)
+		}
+	}
+
+	// the qdisc is shared by both directions and may belong to someone else already
+	if err := netlink.QdiscAdd(clsactQdisc(a.ifindex)); err == nil {
+		a.ownQdisc = true
+	} else if !errors.Is(err, os.ErrExist) && !errors.Is(err, unix.EEXIST) {
+		return nil, fmt.Errorf("adding clsact qdisc: %w", err)
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: a.ifindex,
+			Parent:    parent,
+			Handle:    clsactFilterHandle,
+			Priority:  clsactFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           prog.FD(),
+		Name:         "firewall_container",
+		DirectAction: true,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return nil, fmt.Errorf("adding clsact filter: %w", err)
+	}
+	return &tcHook{mechanism: mechanismClsact, filter: filter}, nil
+}
+
+func clsactQdisc(ifindex int) *netlink.GenericQdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: ifindex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * shared by all LSM modules
+ *
+ * every LSM module includes this header, so the pinned map
+ * /sys/fs/bpf/maps/map_container_cgroup_ids has exactly the same definition
+ * in every program that reuses it (LIBBPF_PIN_BY_NAME).
+ * kernel_spy (john_wick/kernel_spy/kernel_spy.go) mirrors the layout of
+ * struct container_policy in Go, keep both in sync.
+ */
+#ifndef __CONTAINER_POLICY_H
+#define __CONTAINER_POLICY_H
+
+// max 64 docker containers can be observed
+#define MAX_CONTAINERS 64
+
+/*
+ * deepest cgroup level that is searched for a container's cgroup
+ * (level 0 is the root cgroup, docker containers usually live at level 2,
+ * e.g. /system.slice/docker-<id>.scope)
+ * kernel_spy configures the level in the SLOT_CGROUP_LEVEL slot of
+ * map_policy_modes, MAX_CGROUP_LEVEL only bounds the loop for the verifier
+ */
+#define MAX_CGROUP_LEVEL 32
+#define DEFAULT_CGROUP_LEVEL 16
+
+/*
+ * ids of the LSM hooks, used as key of map_policy_modes and in violation
+ * events, the matching POLICY_* bit is (1 << id)
+ */
+#define HOOK_ID_CHMOD 0
+#define HOOK_ID_RMDIR 1
+#define HOOK_ID_FILE_PERMISSION 2
+#define HOOK_ID_UNLINK 3
+#define HOOK_ID_RENAME 4
+#define HOOK_ID_EXEC 5
+#define HOOK_ID_SOCKET_CONNECT 6
+#define HOOK_ID_PTRACE 7
+#define HOOK_ID_MOUNT 8
+#define HOOK_ID_KERNEL_MODULE 9
+#define HOOK_ID_BPF 10
+// not a container hook, only its map_policy_modes slot is used
+#define HOOK_ID_SELF_PROTECT 11
+#define MAX_HOOKS 32
+// not a hook, the map_policy_modes slot that holds the configured cgroup level
+#define SLOT_CGROUP_LEVEL (MAX_HOOKS - 1)
+
+// bits of container_policy.hooks and container_policy.audit
+#define POLICY_CHMOD (1 << HOOK_ID_CHMOD)
+#define POLICY_RMDIR (1 << HOOK_ID_RMDIR)
+#define POLICY_FILE_PERMISSION (1 << HOOK_ID_FILE_PERMISSION)
+#define POLICY_UNLINK (1 << HOOK_ID_UNLINK)
+#define POLICY_RENAME (1 << HOOK_ID_RENAME)
+#define POLICY_EXEC (1 << HOOK_ID_EXEC)
+#define POLICY_SOCKET_CONNECT (1 << HOOK_ID_SOCKET_CONNECT)
+#define POLICY_PTRACE (1 << HOOK_ID_PTRACE)
+#define POLICY_MOUNT (1 << HOOK_ID_MOUNT)
+#define POLICY_KERNEL_MODULE (1 << HOOK_ID_KERNEL_MODULE)
+#define POLICY_BPF (1 << HOOK_ID_BPF)
+
+/*
+ * enforcement modes
+ * enforce: deny the operation and report it
+ * audit:   allow the operation but report that it would have been denied
+ * off:     allow the operation without reporting it
+ * MODE_ENFORCE is 0, so an empty map_policy_modes slot enforces
+ */
+#define MODE_ENFORCE 0
+#define MODE_AUDIT 1
+#define MODE_OFF 2
+
+// bits of path_rule.deny in map_file_rules, same values as the kernel's MAY_* mask
+#define FILE_DENY_EXEC 0x1
+#define FILE_DENY_WRITE 0x2
+#define FILE_DENY_READ 0x4
+#define FILE_DENY_APPEND 0x8
+
+/*
+ * bits of container_policy.chmod_deny and of path_rule.deny in
+ * map_chmod_rules, each bit denies one kind of mode change
+ */
+// setuid or setgid bit gets set
+#define CHMOD_DENY_SETID (1 << 0)
+// write permission for others gets set
+#define CHMOD_DENY_WORLD_WRITABLE (1 << 1)
+// sticky bit gets removed
+#define CHMOD_DENY_STICKY_REMOVAL (1 << 2)
+// exec bits get set on a regular file on a writable mount
+#define CHMOD_DENY_EXEC_WRITABLE_MOUNT (1 << 3)
+// every chmod
+#define CHMOD_DENY_ANY (1 << 4)
+
+// bits of container_policy.exec_flags
+// only executables on the profile's list may run (otherwise: the list is denied)
+#define EXEC_ALLOWLIST (1 << 0)
+// files on the container's writable overlay upper layer must not be executed
+#define EXEC_DENY_UPPER (1 << 1)
+
+/*
+ * actions of the socket_connect rules and values of
+ * container_policy.connect_default, 0 (unset) allows
+ */
+#define CONNECT_ALLOW 1
+#define CONNECT_DENY 2
+
+/*
+ * the profile (john_wick/profiles) a container was assigned,
+ * kernel_spy translates it into this struct
+ * the size has to stay a multiple of 8 (no implicit padding), Go mirrors it
+ */
+struct container_policy {
+  // id of the profile, 0 if none
+  __u32 profile_id;
+  // bitmask of POLICY_* flags, hooks that are not set are off
+  __u32 hooks;
+  // bitmask of POLICY_* flags, hooks that only audit instead of enforcing
+  __u32 audit;
+  // level of the container's cgroup in the cgroup hierarchy
+  __u32 level;
+  // cgroup id of the container (the key of this entry), reported in events
+  __u64 cgroup_id;
+  // bitmask of CHMOD_DENY_* flags that apply to every path
+  __u32 chmod_deny;
+  // bitmask of EXEC_* flags
+  __u32 exec_flags;
+  // CONNECT_* action for destinations that match no socket_connect rule
+  __u32 connect_default;
+  __u32 _pad;
+};
+
+/*
+ * key:   cgroup id of a container (inode of its cgroup directory)
+ * value: policy of that container
+ *
+ * a hash keyed by the cgroup id lets every hook find its container with a
+ * single lookup instead of scanning all entries
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u64);
+  __type(value, struct container_policy);
+  __uint(max_entries, MAX_CONTAINERS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_container_cgroup_ids SEC(".maps");
+
+/*
+ * key:   HOOK_ID_*
+ * value: MODE_* of that hook for all containers
+ *
+ * lets a whole policy be switched to audit or off at runtime without
+ * reloading the programs
+ * slot SLOT_CGROUP_LEVEL holds the deepest cgroup level that is searched for
+ * a container (0: DEFAULT_CGROUP_LEVEL)
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, MAX_HOOKS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_policy_modes SEC(".maps");
+
+/*
+ * return the policy of the container the current task runs in,
+ * or NULL if the task does not belong to an observed container
+ *
+ * a task can also run in a child cgroup of its container (systemd inside the
+ * container, docker exec --cgroup, workloads that create sub-cgroups), so the
+ * ancestors of the current cgroup are checked as well
+ */
+static __always_inline struct container_policy *lookup_container_policy(void) {
+  struct container_policy *policy;
+  __u64 cgrp_id = bpf_get_current_cgroup_id();
+
+  // fast path: the task runs directly in the container's cgroup
+  policy = bpf_map_lookup_elem(&map_container_cgroup_ids, &cgrp_id);
+  if (policy)
+    return policy;
+
+  __u32 slot = SLOT_CGROUP_LEVEL;
+  __u32 *configured = bpf_map_lookup_elem(&map_policy_modes, &slot);
+  __u32 max_level =
+      configured && *configured ? *configured : DEFAULT_CGROUP_LEVEL;
+
+  // slow path: walk down from the root to the task's own cgroup
+  for (int level = 1; level <= MAX_CGROUP_LEVEL; level++) {
+    if (level > max_level)
+      break;
+
+    __u64 ancestor_id = bpf_get_current_ancestor_cgroup_id(level);
+    // 0 means the task's cgroup is not that deep, nothing left to check
+    if (!ancestor_id)
+      break;
+
+    policy = bpf_map_lookup_elem(&map_container_cgroup_ids, &ancestor_id);
+    // the level stored by kernel_spy makes sure the ancestor really is the
+    // container's cgroup at that depth
+    if (policy && policy->level == level)
+      return policy;
+  }
+
+  return NULL;
+}
+
+/*
+ * combine the mode of the whole policy (map_policy_modes) with the mode of
+ * the container (container_policy.hooks/audit), the less strict one wins
+ */
+static __always_inline __u32 policy_mode(struct container_policy *policy,
+                                         __u32 hook_id) {
+  __u32 hook_bit = 1 << hook_id;
+
+  if (!policy || !(policy->hooks & hook_bit))
+    return MODE_OFF;
+
+  __u32 *global = bpf_map_lookup_elem(&map_policy_modes, &hook_id);
+  if (global && *global == MODE_OFF)
+    return MODE_OFF;
+  if ((global && *global == MODE_AUDIT) || (policy->audit & hook_bit))
+    return MODE_AUDIT;
+
+  return MODE_ENFORCE;
+}
+
+// return value of an LSM hook for the given mode
+static __always_inline int mode_verdict(__u32 mode) {
+  return mode == MODE_ENFORCE ? -EPERM : 0;
+}
+
+#endif /* __CONTAINER_POLICY_H */
@@ -0,0 +1,32 @@
+/*
+ * shared by the LSM modules that need to know which layer of a container's
+ * overlay root filesystem a file lives on
+ */
+#ifndef __OVERLAY_H
+#define __OVERLAY_H
+
+#include <bpf/bpf_core_read.h>
+
+// magic number of overlayfs, not part of vmlinux.h
+#define OVERLAYFS_SUPER_MAGIC 0x794c7630
+
+/*
+ * returns 1 if the file was created (or copied up) by the container, i.e. it
+ * lives on the writable upper layer of the container's overlay root filesystem
+ *
+ * struct ovl_inode is not part of vmlinux.h, but its __upperdentry directly
+ * follows the embedded vfs inode. it is only set once the file exists on the
+ * upper layer, a copied-up file keeps the inode number of its lower file
+ * (samefs, xino), so the inode numbers can't tell the layers apart
+ */
+static __always_inline int on_upper_layer(struct inode *inode) {
+  if (BPF_CORE_READ(inode, i_sb, s_magic) != OVERLAYFS_SUPER_MAGIC)
+    return 0;
+
+  struct dentry *upper = NULL;
+  bpf_probe_read_kernel(&upper, sizeof(upper),
+                        (char *)inode + bpf_core_type_size(struct inode));
+  return upper != NULL;
+}
+
+#endif /* __OVERLAY_H */
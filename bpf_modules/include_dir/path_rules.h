@@ -0,0 +1,111 @@
+/*
+ * shared by the LSM modules that match paths against rules
+ *
+ * a rule is an exact path, a prefix (e.g. "/run/secrets/") or a suffix
+ * (e.g. ".pem"). kernel_spy (john_wick/kernel_spy/rules.go) translates the
+ * glob patterns of the profile configuration into rules and mirrors the layout
+ * of struct path_rule in Go, keep both in sync.
+ */
+#ifndef __PATH_RULES_H
+#define __PATH_RULES_H
+
+// size of the buffer a path is resolved into, must be a power of 2
+#define PATH_BUF_LEN 256
+// max length of a rule's pattern
+#define PATH_RULE_LEN 64
+// number of rule slots in every rule map
+#define MAX_PATH_RULES 32
+
+// values of path_rule.match, 0 marks an unused slot
+#define RULE_MATCH_EXACT 1
+#define RULE_MATCH_PREFIX 2
+#define RULE_MATCH_SUFFIX 3
+
+struct path_rule {
+  // RULE_MATCH_*
+  __u32 match;
+  // length of pattern (without NUL)
+  __u32 len;
+  // FILE_DENY_* mask (or another per-module mask) applied on a match
+  __u32 deny;
+  // profile the rule belongs to, 0 applies to every profile
+  __u32 profile_id;
+  char pattern[PATH_RULE_LEN];
+};
+
+// per-CPU scratch space, a resolved path does not fit on the bpf stack
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __type(key, __u32);
+  __type(value, char[PATH_BUF_LEN]);
+  __uint(max_entries, 1);
+} map_path_buffer SEC(".maps");
+
+static __always_inline char *path_buffer(void) {
+  __u32 zero = 0;
+
+  return bpf_map_lookup_elem(&map_path_buffer, &zero);
+}
+
+/*
+ * compare path (path_len characters, without NUL) against a single rule
+ * returns 1 on a match
+ */
+static __always_inline int path_rule_matches(const struct path_rule *rule,
+                                             const char *path,
+                                             __u32 path_len) {
+  __u32 len = rule->len;
+  __u32 offset = 0;
+
+  if (len == 0 || len > PATH_RULE_LEN || len > path_len)
+    return 0;
+
+  switch (rule->match) {
+  case RULE_MATCH_EXACT:
+    if (len != path_len)
+      return 0;
+    break;
+  case RULE_MATCH_PREFIX:
+    break;
+  case RULE_MATCH_SUFFIX:
+    // compare the last len characters
+    offset = path_len - len;
+    break;
+  default:
+    return 0;
+  }
+
+  for (__u32 i = 0; i < PATH_RULE_LEN; i++) {
+    if (i >= len)
+      break;
+    // the mask keeps the index inside the buffer for the verifier
+    if (path[(offset + i) & (PATH_BUF_LEN - 1)] != rule->pattern[i])
+      return 0;
+  }
+  return 1;
+}
+
+/*
+ * check path against every rule of the given rule map that applies to the
+ * profile and return the union of the deny masks of all matching rules
+ */
+static __always_inline __u32 match_path_rules(void *rule_map, __u32 profile_id,
+                                              const char *path,
+                                              __u32 path_len) {
+  __u32 deny = 0;
+
+  for (__u32 i = 0; i < MAX_PATH_RULES; i++) {
+    __u32 key = i;
+    struct path_rule *rule = bpf_map_lookup_elem(rule_map, &key);
+    if (!rule || !rule->match)
+      continue;
+    if (rule->profile_id && rule->profile_id != profile_id)
+      continue;
+
+    if (path_rule_matches(rule, path, path_len))
+      deny |= rule->deny;
+  }
+  return deny;
+}
+
+#endif /* __PATH_RULES_H */
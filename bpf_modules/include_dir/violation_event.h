@@ -0,0 +1,86 @@
+/*
+ * shared by all LSM modules
+ *
+ * every denied operation is reported as a struct violation_event through the
+ * pinned ring buffer /sys/fs/bpf/maps/map_violation_events.
+ * john_wick/violations reads the ring buffer and mirrors the layout of
+ * struct violation_event in Go, keep both in sync.
+ * include container_policy.h before this header.
+ */
+#ifndef __VIOLATION_EVENT_H
+#define __VIOLATION_EVENT_H
+
+#define TASK_COMM_LEN 16
+#define EVENT_PATH_LEN 256
+#define EVENT_FSTYPE_LEN 16
+
+// values of violation_event.decision
+#define DECISION_DENY 0
+// audit mode: the operation was allowed but would have been denied
+#define DECISION_AUDIT 1
+
+struct violation_event {
+  // nanoseconds since boot (bpf_ktime_get_boot_ns)
+  __u64 timestamp_ns;
+  // cgroup id of the container the task belongs to
+  __u64 cgroup_id;
+  // thread id and process id of the task
+  __u32 pid;
+  __u32 tgid;
+  __u32 uid;
+  // HOOK_ID_* (container_policy.h) of the program that reported the event
+  __u32 hook;
+  // DECISION_*
+  __u32 decision;
+  // requested mode (chmod), access mask (file_permission) or a hook specific
+  // detail (e.g. the mount flags)
+  __u32 mode;
+  char comm[TASK_COMM_LEN];
+  // path or filename the operation was attempted on
+  char path[EVENT_PATH_LEN];
+  // mount hooks: requested source (device) and filesystem type
+  char source[EVENT_PATH_LEN];
+  char fstype[EVENT_FSTYPE_LEN];
+};
+
+// one ring buffer shared by all LSM programs
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 256 * 1024);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_violation_events SEC(".maps");
+
+/*
+ * reserve an event in the ring buffer and fill in everything that is known
+ * about the current task, the caller adds path and mode and submits it with
+ * bpf_ringbuf_submit()
+ * mode is the MODE_* the hook runs in, it decides the reported decision
+ * returns NULL if the ring buffer is full
+ */
+static __always_inline struct violation_event *
+reserve_violation(struct container_policy *policy, __u32 hook, __u32 mode) {
+  struct violation_event *e;
+
+  e = bpf_ringbuf_reserve(&map_violation_events, sizeof(*e), 0);
+  if (!e)
+    return NULL;
+
+  __u64 pid_tgid = bpf_get_current_pid_tgid();
+
+  e->timestamp_ns = bpf_ktime_get_boot_ns();
+  e->cgroup_id = policy ? policy->cgroup_id : 0;
+  e->pid = (__u32)pid_tgid;
+  e->tgid = pid_tgid >> 32;
+  e->uid = (__u32)bpf_get_current_uid_gid();
+  e->hook = hook;
+  e->decision = mode == MODE_AUDIT ? DECISION_AUDIT : DECISION_DENY;
+  e->mode = 0;
+  e->path[0] = '\0';
+  e->source[0] = '\0';
+  e->fstype[0] = '\0';
+  bpf_get_current_comm(e->comm, sizeof(e->comm));
+
+  return e;
+}
+
+#endif /* __VIOLATION_EVENT_H */
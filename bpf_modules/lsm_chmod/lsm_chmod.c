@@ -5,39 +5,103 @@
 #include <bpf/bpf_tracing.h>
 #include <linux/errno.h>
 
+#include "../include_dir/container_policy.h"
+#include "../include_dir/path_rules.h"
+#include "../include_dir/violation_event.h"
+
+// macros from the kernel headers, they are not part of vmlinux.h
+#define S_IFMT 00170000
+#define S_IFREG 0100000
+#define S_ISUID 0004000
+#define S_ISGID 0002000
+#define S_ISVTX 0001000
+#define S_IWOTH 00002
+#define S_IXUGO 00111
+#define MNT_READONLY 0x40
+#define SB_RDONLY 1
+
 char _license[] SEC("license") = "GPL";
 
+/*
+ * chmod rules scoped to paths (e.g. "/app/*"), filled by kernel_spy from the
+ * profile configuration, path_rule.deny is a CHMOD_DENY_* mask
+ */
 struct {
-  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(type, BPF_MAP_TYPE_ARRAY);
   __type(key, __u32);
-  __type(value, __u64);
-  // max 64 docker containers can be observed
-  __uint(max_entries, 64);
+  __type(value, struct path_rule);
+  __uint(max_entries, MAX_PATH_RULES);
   __uint(pinning, LIBBPF_PIN_BY_NAME);
-} map_container_cgroup_ids SEC(".maps");
+} map_chmod_rules SEC(".maps");
+
+/*
+ * compare the current mode of the file with the requested one and return
+ * the kinds of change (CHMOD_DENY_*) this chmod performs
+ */
+static __always_inline __u32 chmod_changes(const struct path *path,
+                                           umode_t mode) {
+  struct inode *inode = path->dentry->d_inode;
+  umode_t old = inode->i_mode;
+  // permission bits that are set now but were not set before
+  umode_t added = mode & ~old;
+  __u32 changes = CHMOD_DENY_ANY;
+
+  if (added & (S_ISUID | S_ISGID))
+    changes |= CHMOD_DENY_SETID;
+  if (added & S_IWOTH)
+    changes |= CHMOD_DENY_WORLD_WRITABLE;
+  if ((old & S_ISVTX) && !(mode & S_ISVTX))
+    changes |= CHMOD_DENY_STICKY_REMOVAL;
+  // a writable mount lets the container drop a file there and execute it
+  if ((added & S_IXUGO) && (old & S_IFMT) == S_IFREG &&
+      !(path->mnt->mnt_flags & MNT_READONLY) &&
+      !(inode->i_sb->s_flags & SB_RDONLY))
+    changes |= CHMOD_DENY_EXEC_WRITABLE_MOUNT;
+
+  return changes;
+}
 
 SEC("lsm/path_chmod")
 int BPF_PROG(path_chmod, const struct path *path, umode_t mode) {
-  __u32 key;
-  __u64 *value;
-  __u64 cgrp_id = bpf_get_current_cgroup_id();
-  bpf_printk("current cgroup_id: %llu\n", cgrp_id);
-
-// loop through all cgroup ids
-#pragma unroll
-  for (int i = 0; i < 64; i++) {
-    key = i;
-    value = bpf_map_lookup_elem(&map_container_cgroup_ids, &key);
-    if (!value)
-      continue;
-
-    if (cgrp_id == *value) {
-      bpf_printk("matched cgroup_id %llu in map at key %d → blocking chmod\n",
-                 cgrp_id, i);
-      return -EPERM;
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 enforcement = policy_mode(policy, HOOK_ID_CHMOD);
+  if (!policy || enforcement == MODE_OFF)
+    // allow chmod
+    return 0;
+
+  // changes denied everywhere by the profile
+  __u32 deny = policy->chmod_deny;
+
+  // plus the changes denied below the paths of the profile's scoped rules
+  __u32 path_len = 0;
+  char *buf = path_buffer();
+  if (buf) {
+    long len = bpf_d_path((struct path *)path, buf, PATH_BUF_LEN);
+    if (len > 0) {
+      // bpf_d_path counts the terminating NUL
+      path_len = (__u32)(len - 1) & (PATH_BUF_LEN - 1);
+      deny |= match_path_rules(&map_chmod_rules, policy->profile_id, buf,
+                               path_len);
     }
   }
 
-  // else allow chmod
-  return 0;
+  // harmless mode changes (e.g. chmod 644) are allowed
+  if (!(chmod_changes(path, mode) & deny))
+    return 0;
+
+  // report the blocked (or in audit mode: allowed) chmod
+  struct violation_event *e =
+      reserve_violation(policy, HOOK_ID_CHMOD, enforcement);
+  if (e) {
+    e->mode = mode;
+    if (buf && path_len)
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), buf);
+    else
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path),
+                                path->dentry->d_name.name);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(enforcement);
 }
@@ -0,0 +1,117 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/overlay.h"
+#include "../include_dir/path_rules.h"
+#include "../include_dir/violation_event.h"
+
+// reported in violation_event.mode, why an exec was denied
+#define EXEC_REASON_NOT_LISTED 1
+#define EXEC_REASON_LISTED 2
+#define EXEC_REASON_UPPER_LAYER 3
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * an executable on the list of a profile, identified by the device of its
+ * filesystem (the kernel's s_dev encoding) and its inode number
+ * kernel_spy resolves the exact paths of the profile inside every container
+ * through /proc/<pid>/root and mirrors this layout in Go, keep both in sync
+ */
+struct exec_inode {
+  __u64 ino;
+  __u32 dev;
+  __u32 profile_id;
+};
+
+// listed executables of all containers, the value is unused
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct exec_inode);
+  __type(value, __u32);
+  __uint(max_entries, 1024);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_exec_inodes SEC(".maps");
+
+/*
+ * listed executables given as path patterns (e.g. "/usr/bin/*"), filled by
+ * kernel_spy from the profile configuration
+ * whether the list allows or denies depends on EXEC_ALLOWLIST of the profile
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, struct path_rule);
+  __uint(max_entries, MAX_PATH_RULES);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_exec_rules SEC(".maps");
+
+/*
+ * called for the executable and again for every interpreter it needs
+ * (e.g. /bin/sh for a script), so an allowlist has to contain both
+ */
+SEC("lsm/bprm_check_security")
+int BPF_PROG(bprm_check_security, struct linux_binprm *bprm) {
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_EXEC);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  struct file *file = bprm->file;
+  struct inode *inode = file->f_inode;
+  __u32 reason = 0;
+
+  if ((policy->exec_flags & EXEC_DENY_UPPER) && on_upper_layer(inode))
+    reason = EXEC_REASON_UPPER_LAYER;
+
+  char *buf = path_buffer();
+  __u32 path_len = 0;
+  if (buf) {
+    long len = bpf_d_path(&file->f_path, buf, PATH_BUF_LEN);
+    if (len > 0)
+      // bpf_d_path counts the terminating NUL
+      path_len = (__u32)(len - 1) & (PATH_BUF_LEN - 1);
+  }
+
+  if (!reason) {
+    struct exec_inode key = {
+        .ino = inode->i_ino,
+        .dev = inode->i_sb->s_dev,
+        .profile_id = policy->profile_id,
+    };
+    int listed = bpf_map_lookup_elem(&map_exec_inodes, &key) != NULL;
+    if (!listed && path_len)
+      listed = match_path_rules(&map_exec_rules, policy->profile_id, buf,
+                                path_len) != 0;
+
+    if (policy->exec_flags & EXEC_ALLOWLIST) {
+      if (!listed)
+        reason = EXEC_REASON_NOT_LISTED;
+    } else if (listed) {
+      reason = EXEC_REASON_LISTED;
+    }
+  }
+
+  if (!reason)
+    return 0;
+
+  // report the blocked (or in audit mode: allowed) exec
+  struct violation_event *e = reserve_violation(policy, HOOK_ID_EXEC, mode);
+  if (e) {
+    e->mode = reason;
+    if (buf && path_len)
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), buf);
+    else
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), bprm->filename);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
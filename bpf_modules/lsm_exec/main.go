@@ -0,0 +1,88 @@
+/*
+ * documentation: https://ebpf-go.dev/guides/getting-started/#compile-ebpf-c-and-generate-scaffolding-using-bpf2go
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+const (
+	mapKey    uint32 = 0
+	bpfFSPath        = "/sys/fs/bpf"
+)
+
+func main() {
+	// Remove resource limits for kernels <5.11.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatalf("failed to remove memory lock: %v", err)
+	}
+
+	fn := "maps"
+
+	pinPath := path.Join(bpfFSPath, fn)
+	if err := os.MkdirAll(pinPath, os.ModePerm); err != nil {
+		log.Fatalf("failed to create bpf fs subpath: %+v", err)
+	}
+
+	objs := lsm_execObjects{}
+	if err := loadLsm_execObjects(&objs, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: pinPath,
+		},
+	}); err != nil {
+		log.Fatalf("failed to load into the kernel: %v", err)
+	}
+	defer objs.Close()
+
+	/*
+	 * Load the compiled eBPF ELF and load it into the kernel.
+	 *
+	 * objs is an instance of the struct lsm_execObjects
+	 * the struct is auto-generated by go generate
+	 * the name of the struct can be seen in the file lsm_exec_bpfel.go
+	 * loadLsm_execObjects is a function that loads the programs and maps from the eBPF object file into the kernel
+	 * and assigns them to the provided Go struct (lsm_execPrograms or lsm_execMaps)
+	 * objs.Close() is a method of lsm_execObjects struct and unloads the eBPF program from the kernel
+	 * the GO keyword defer ensures that the deferred call's arguments are evaluated immediately,
+	 * but the function call is not executed until the surrounding function returns
+	 */
+
+	/*
+	 * The link.AttachLSM function attaches the eBPF program to the appropriate LSM hook,
+	 * but it’s the eBPF program itself that determines which LSM hook it is attaching to,
+	 * based on its definition (in this case lsm/bprm_check_security)
+	 * The LSMOptions struct contains options for how the eBPF program should be attached,
+	 * like which program to attach (the BprmCheckSecurity Program in this case) and any other configuration options.
+	 * execHook is a variable of type link.Link (from the github.com/cilium/ebpf/link package).
+	 * it represents the connection between the eBPF program and the LSM hook
+	 * it manages the lifecycle of the link with methods such as Close()
+	 * Close() ensures that the link between the eBPF program and the LSM hook (execve syscall in this case)
+	 * is properly cleaned up
+	 */
+	execHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.BprmCheckSecurity,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer execHook.Close()
+
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+	log.Printf("                 successfully loaded lsm_exec ")
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+
+	// Wait for a signal (e.g. control c) to exit.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	log.Println("Received interrupt, detaching program")
+}
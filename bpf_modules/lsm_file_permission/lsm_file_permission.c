@@ -4,81 +4,152 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 #include <linux/errno.h>
-#include <string.h>
 
-#define EXECUTE 0x1
-#define WRITE 0x2
+#include "../include_dir/container_policy.h"
+#include "../include_dir/path_rules.h"
+#include "../include_dir/violation_event.h"
+
+// macros from the kernel headers, they are not part of vmlinux.h
+#define O_APPEND 02000
+#define FMODE_EXEC 0x20
+#define MAY_WRITE 0x2
 
 char _license[] SEC("license") = "GPL";
 
+/*
+ * rules that protect files, filled by kernel_spy from the profile configuration
+ * (e.g. "/run/secrets/*" or "*.pem"), every rule carries its own FILE_DENY_*
+ * mask
+ */
 struct {
-  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(type, BPF_MAP_TYPE_ARRAY);
   __type(key, __u32);
-  __type(value, __u64);
-  __uint(max_entries, 64);
+  __type(value, struct path_rule);
+  __uint(max_entries, MAX_PATH_RULES);
   __uint(pinning, LIBBPF_PIN_BY_NAME);
-} map_container_cgroup_ids SEC(".maps");
+} map_file_rules SEC(".maps");
 
-SEC("lsm/file_permission")
-int BPF_PROG(file_permission, struct file *file, int mask) {
-  char filename[256];
-  const char *suffix = "confidential";
-  int suffix_len = 12;
-
-  __u32 key;
-  __u64 *value;
-  __u64 cgrp_id = bpf_get_current_cgroup_id();
-  bool cgroupid_exists;
-
-// loop through all cgroup ids
-#pragma unroll
-  for (int i = 0; i < 64; i++) {
-    key = i;
-    value = bpf_map_lookup_elem(&map_container_cgroup_ids, &key);
-    if (!value)
-      continue;
-
-    if (cgrp_id == *value) {
-      cgroupid_exists = true;
-    }
+/*
+ * key:   address of an open struct file
+ * value: FILE_DENY_* mask of the rules that matched the file's path
+ *
+ * file_permission runs on every read and write, too often to resolve the path
+ * and check every rule. The path is resolved once in file_open (bpf_d_path is
+ * only allowed in sleepable hooks such as file_open, not in file_permission)
+ * and only files that match a rule get an entry, which file_free_security
+ * removes again before the address can be reused.
+ * not an LRU map: an evicted entry would let every later access to its file
+ * through, a file that does not fit is not opened at all
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u64);
+  __type(value, __u32);
+  __uint(max_entries, 65536);
+} map_file_verdicts SEC(".maps");
+
+// report the denied (or in audit mode: allowed) access and return the verdict
+static __always_inline int deny_file(struct container_policy *policy,
+                                     __u32 mode, struct file *file,
+                                     __u32 access) {
+  struct violation_event *e =
+      reserve_violation(policy, HOOK_ID_FILE_PERMISSION, mode);
+  if (e) {
+    e->mode = access;
+    bpf_probe_read_kernel_str(e->path, sizeof(e->path),
+                              file->f_path.dentry->d_name.name);
+    bpf_ringbuf_submit(e, 0);
   }
+  return mode_verdict(mode);
+}
+
+SEC("lsm/file_open")
+int BPF_PROG(file_open, struct file *file) {
+  // the mode is checked on every access, so a switch to enforce also applies to
+  // files that were opened in audit or off mode
+  struct container_policy *policy = lookup_container_policy();
+  if (!policy || !(policy->hooks & POLICY_FILE_PERMISSION))
+    return 0;
+
+  char *path = path_buffer();
+  if (!path)
+    return 0;
+
+  /*
+   * resolve the full path of the file as seen from inside the container
+   * (e.g. /run/secrets/db_password), so rules can match on the directory or
+   * mount a file lives in and not only on its name
+   */
+  long len = bpf_d_path(&file->f_path, path, PATH_BUF_LEN);
+  if (len <= 0) {
+    // no path available, fall back to the filename
+    len = bpf_probe_read_kernel_str(path, PATH_BUF_LEN,
+                                    file->f_path.dentry->d_name.name);
+    if (len <= 0)
+      return 0;
+  }
+  // both helpers count the terminating NUL
+  __u32 path_len = (__u32)(len - 1) & (PATH_BUF_LEN - 1);
+
+  __u32 deny =
+      match_path_rules(&map_file_rules, policy->profile_id, path, path_len);
+  if (!deny)
+    return 0;
 
-  if (cgroupid_exists) {
-    // read filename that is being accessed
-    bpf_probe_read_str(filename, sizeof(filename),
-                       file->f_path.dentry->d_name.name);
-
-    int filename_len = 0;
-
-    // iterate through the filename and count the letters
-#pragma unroll
-    for (int i = 0; i < sizeof(filename); i++) {
-      if (filename[i] == '\0')
-        break;
-      filename_len++;
-    }
-
-    // make sure the filename is long enough to possibly end with "confidential"
-    // If it's shorter than 12 characters, it can’t match, so skip the check
-    if (filename_len >= suffix_len) {
-      /*
-       * &filename[filename_len - suffix_len] → points to the last N characters
-       * of the filename. e.g. banana.confidential = 19 letters. 19 - suffix_len
-       * = 19 - 12 = 7. -> pointer = &filename[7] = "confidential" in this case.
-       * Lastly both pointers get compared.
-       */
-      if (memcmp(&filename[filename_len - suffix_len], suffix, suffix_len) ==
-          0) {
-        bpf_printk("Access to confidential file: %s\n", filename);
-        bpf_printk("Requested access mask: %d\n", mask);
-
-        // was this a write or execute access?
-        if ((mask & WRITE) | (mask & EXECUTE)) {
-          bpf_printk("Write/execute denied for file: %s\n", filename);
-          return -EPERM;
-        }
-      }
-    }
+  /*
+   * file_permission only sees reads and writes, exec and append are decided
+   * here: an open by execve carries FMODE_EXEC, an append an O_APPEND
+   */
+  __u32 access = 0;
+  if (file->f_mode & FMODE_EXEC)
+    access |= FILE_DENY_EXEC;
+  if (file->f_flags & O_APPEND)
+    access |= FILE_DENY_APPEND;
+  __u32 mode = policy_mode(policy, HOOK_ID_FILE_PERMISSION);
+  if ((access & deny) && mode != MODE_OFF) {
+    int ret = deny_file(policy, mode, file, access & deny);
+    if (ret)
+      return ret;
   }
+
+  __u64 key = (__u64)file;
+  if (bpf_map_update_elem(&map_file_verdicts, &key, &deny, BPF_ANY)) {
+    // without the entry file_permission would allow every access, fail closed
+    if (mode == MODE_OFF)
+      return 0;
+    return deny_file(policy, mode, file, deny);
+  }
+  return 0;
+}
+
+SEC("lsm/file_permission")
+int BPF_PROG(file_permission, struct file *file, int mask) {
+  // file_permission runs on every read and write, so keep this a single lookup
+  __u64 key = (__u64)file;
+  __u32 *deny = bpf_map_lookup_elem(&map_file_verdicts, &key);
+  if (!deny)
+    return 0;
+
+  // a write to a file that got O_APPEND after the open (fcntl) is an append
+  __u32 access = mask;
+  if ((mask & MAY_WRITE) && (file->f_flags & O_APPEND))
+    access |= FILE_DENY_APPEND;
+  // is this access type denied by any rule that matched at open?
+  if (!(access & *deny))
+    return 0;
+
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_FILE_PERMISSION);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_file(policy, mode, file, access & *deny);
+}
+
+// the file is closed for good, its address can be reused by the next file
+SEC("lsm/file_free_security")
+int BPF_PROG(file_free_security, struct file *file) {
+  __u64 key = (__u64)file;
+  bpf_map_delete_elem(&map_file_verdicts, &key);
   return 0;
 }
@@ -54,6 +54,26 @@ func main() {
 		log.Fatalf("failed to load into the kernel: %v", err)
 	}
 	defer objs.Close()
+	/*
+	 * the rules are matched when a file is opened, file_permission only checks the result
+	 * file_free_security is attached first, so no verdict outlives its file
+	 */
+	freeHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.FileFreeSecurity,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer freeHook.Close()
+
+	openHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.FileOpen,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer openHook.Close()
+
 	/*
 	 * The link.AttachLSM function attaches the eBPF program to the appropriate LSM hook,
 	 * but it’s the eBPF program itself that determines which LSM hook it is attaching to,
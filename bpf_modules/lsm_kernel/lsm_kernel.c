@@ -0,0 +1,102 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/violation_event.h"
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * report the blocked (or in audit mode: allowed) operation and return the verdict
+ * a trusted container (e.g. a monitoring agent that loads bpf programs) is
+ * exempted by a profile without the kernel_module or bpf hook
+ */
+static __always_inline int deny_kernel(struct container_policy *policy,
+                                       __u32 hook_id, __u32 mode,
+                                       const char *name, __u32 detail) {
+  struct violation_event *e = reserve_violation(policy, hook_id, mode);
+  if (e) {
+    e->mode = detail;
+    if (name)
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), name);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+// request_module(), e.g. a socket of an unusual protocol family auto-loads a module
+SEC("lsm/kernel_module_request")
+int BPF_PROG(kernel_module_request, char *kmod_name) {
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_KERNEL_MODULE);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_kernel(policy, HOOK_ID_KERNEL_MODULE, mode, kmod_name, 0);
+}
+
+// finit_module(2), the module is read from a file
+SEC("lsm/kernel_read_file")
+int BPF_PROG(kernel_read_file, struct file *file, enum kernel_read_file_id id,
+             bool contents) {
+  // firmware, kexec images and policies are read the same way
+  if (id != READING_MODULE)
+    return 0;
+
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_KERNEL_MODULE);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_kernel(policy, HOOK_ID_KERNEL_MODULE, mode,
+                     (const char *)file->f_path.dentry->d_name.name, id);
+}
+
+// init_module(2), the module is passed as a buffer
+SEC("lsm/kernel_load_data")
+int BPF_PROG(kernel_load_data, enum kernel_load_data_id id, bool contents) {
+  if (id != LOADING_MODULE)
+    return 0;
+
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_KERNEL_MODULE);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_kernel(policy, HOOK_ID_KERNEL_MODULE, mode, NULL, id);
+}
+
+/*
+ * every bpf(2) command, a container must neither load programs nor detach or
+ * modify the programs and maps of john_wick
+ * the command (BPF_*) is reported in the mode field
+ */
+SEC("lsm/bpf")
+int BPF_PROG(bpf_syscall, int cmd, union bpf_attr *attr, unsigned int size) {
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_BPF);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_kernel(policy, HOOK_ID_BPF, mode, NULL, cmd);
+}
+
+/*
+ * a file descriptor of a bpf program is handed to the task (after loading,
+ * BPF_PROG_GET_FD_BY_ID or BPF_OBJ_GET of a pinned program)
+ */
+SEC("lsm/bpf_prog")
+int BPF_PROG(bpf_prog, struct bpf_prog *prog) {
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_BPF);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return deny_kernel(policy, HOOK_ID_BPF, mode, prog->aux->name, prog->type);
+}
@@ -0,0 +1,174 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/violation_event.h"
+
+// macros from the kernel headers, they are not part of vmlinux.h
+#define MS_REMOUNT 32
+#define MS_BIND 4096
+#define MS_MOVE 8192
+#define MS_UNBINDABLE (1 << 17)
+#define MS_PRIVATE (1 << 18)
+#define MS_SLAVE (1 << 19)
+#define MS_SHARED (1 << 20)
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * a filesystem type (e.g. "tmpfs") containers with the given profile may
+ * mount, filled by kernel_spy from the profile configuration
+ * operations without a filesystem type use the names "bind", "remount",
+ * "move", "propagation" and "umount"
+ * kernel_spy mirrors this layout in Go, keep both in sync
+ */
+struct mount_fstype {
+  __u32 profile_id;
+  char fstype[EVENT_FSTYPE_LEN];
+};
+
+// allowed filesystem types of all profiles, the value is unused
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct mount_fstype);
+  __type(value, __u32);
+  __uint(max_entries, 256);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_mount_fstypes SEC(".maps");
+
+// returns 1 if the profile allows the filesystem type in key
+static __always_inline int fstype_allowed(struct mount_fstype *key) {
+  return bpf_map_lookup_elem(&map_mount_fstypes, key) != NULL;
+}
+
+/*
+ * report the blocked (or in audit mode: allowed) operation with source,
+ * target and filesystem type and return the verdict
+ * target is the path that is resolved with bpf_d_path, target_name is used
+ * instead if target is NULL
+ * bpf_d_path is only allowed in sleepable hooks (sb_mount), every other hook
+ * has to pass NULL as target
+ */
+static __always_inline int deny_mount(struct container_policy *policy,
+                                      __u32 mode, const char *source,
+                                      const struct path *target,
+                                      const char *target_name,
+                                      const char *fstype, __u32 flags) {
+  struct violation_event *e = reserve_violation(policy, HOOK_ID_MOUNT, mode);
+  if (e) {
+    e->mode = flags;
+    if (source)
+      bpf_probe_read_kernel_str(e->source, sizeof(e->source), source);
+    if (target)
+      bpf_d_path((struct path *)target, e->path, sizeof(e->path));
+    else if (target_name)
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), target_name);
+    bpf_probe_read_kernel_str(e->fstype, sizeof(e->fstype), fstype);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+// mount(2): new mounts, bind mounts, remounts, moves and propagation changes
+SEC("lsm/sb_mount")
+int BPF_PROG(sb_mount, const char *dev_name, const struct path *path,
+             const char *type, unsigned long flags, void *data) {
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_MOUNT);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  struct mount_fstype key = {
+      .profile_id = policy->profile_id,
+  };
+
+  // the filesystem type is only used for new mounts, same order as do_mount()
+  if (flags & MS_REMOUNT)
+    __builtin_memcpy(key.fstype, "remount", sizeof("remount"));
+  else if (flags & MS_BIND)
+    __builtin_memcpy(key.fstype, "bind", sizeof("bind"));
+  else if (flags & (MS_SHARED | MS_PRIVATE | MS_SLAVE | MS_UNBINDABLE))
+    __builtin_memcpy(key.fstype, "propagation", sizeof("propagation"));
+  else if (flags & MS_MOVE)
+    __builtin_memcpy(key.fstype, "move", sizeof("move"));
+  else if (type)
+    bpf_probe_read_kernel_str(key.fstype, sizeof(key.fstype), type);
+
+  if (fstype_allowed(&key))
+    return 0;
+
+  return deny_mount(policy, mode, dev_name, path, NULL, key.fstype,
+                    (__u32)flags);
+}
+
+/*
+ * move_mount(2), moves a mount or attaches one created with the new mount api
+ * a detached mount (fsmount, open_tree clone) is new to the container, so it
+ * needs its filesystem type on the list, "move" only covers attached mounts
+ */
+SEC("lsm/move_mount")
+int BPF_PROG(move_mount, const struct path *from_path,
+             const struct path *to_path) {
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_MOUNT);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  struct mount_fstype key = {
+      .profile_id = policy->profile_id,
+  };
+  const char *fstype = BPF_CORE_READ(from_path, mnt, mnt_sb, s_type, name);
+
+  /*
+   * struct mount embeds the vfsmount, detached mounts live in an anonymous
+   * mount namespace (seq 0)
+   */
+  struct vfsmount *mnt = BPF_CORE_READ(from_path, mnt);
+  struct mount *m = (void *)mnt - bpf_core_field_offset(struct mount, mnt);
+  if (BPF_CORE_READ(m, mnt_ns, seq) == 0)
+    bpf_probe_read_kernel_str(key.fstype, sizeof(key.fstype), fstype);
+  else
+    __builtin_memcpy(key.fstype, "move", sizeof("move"));
+  if (fstype_allowed(&key))
+    return 0;
+
+  // move_mount is not sleepable, so only the name of the target is reported
+  const unsigned char *target = BPF_CORE_READ(to_path, dentry, d_name.name);
+  return deny_mount(policy, mode, NULL, NULL, (const char *)target, fstype,
+                    0);
+}
+
+/*
+ * umount(2), unmounting can uncover what docker masks (e.g. /proc/kcore
+ * is hidden by a bind mount)
+ */
+SEC("lsm/sb_umount")
+int BPF_PROG(sb_umount, struct vfsmount *mnt, int flags) {
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_MOUNT);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  struct mount_fstype key = {
+      .profile_id = policy->profile_id,
+  };
+  __builtin_memcpy(key.fstype, "umount", sizeof("umount"));
+  if (fstype_allowed(&key))
+    return 0;
+
+  // struct mount embeds the vfsmount, it knows the source and the mount point
+  struct mount *m = (void *)mnt - bpf_core_field_offset(struct mount, mnt);
+  const char *source = BPF_CORE_READ(m, mnt_devname);
+  const unsigned char *target = BPF_CORE_READ(m, mnt_mountpoint, d_name.name);
+  const char *fstype = BPF_CORE_READ(mnt, mnt_sb, s_type, name);
+
+  return deny_mount(policy, mode, source, NULL, (const char *)target, fstype,
+                    (__u32)flags);
+}
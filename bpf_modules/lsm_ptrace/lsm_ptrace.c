@@ -0,0 +1,106 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/overlay.h"
+#include "../include_dir/violation_event.h"
+
+/*
+ * macro from the kernel headers, it is not part of vmlinux.h
+ * PTRACE_MODE_READ is used for harmless reads of /proc (ps, top), only
+ * attaching is denied: ptrace(PTRACE_ATTACH), /proc/<pid>/mem and
+ * process_vm_readv/writev
+ */
+#define PTRACE_MODE_ATTACH 0x02
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * the executable of a tracer (e.g. /usr/bin/gdb) that may trace inside
+ * containers with the given profile, identified like struct exec_inode of
+ * lsm_exec by the device of its filesystem and its inode number
+ * kernel_spy resolves the paths of the profile inside every container and
+ * mirrors this layout in Go, keep both in sync
+ */
+struct ptrace_exempt {
+  __u64 ino;
+  __u32 dev;
+  __u32 profile_id;
+};
+
+// exempted tracers of all profiles, the value is unused
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct ptrace_exempt);
+  __type(value, __u32);
+  __uint(max_entries, 256);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_ptrace_exempt SEC(".maps");
+
+/*
+ * shared by both hooks: deny (or audit) that tracer traces tracee
+ * returns 0 if the tracer is exempted by the profile
+ */
+static __always_inline int check_ptrace(struct container_policy *policy,
+                                        __u32 mode, struct task_struct *tracer,
+                                        struct task_struct *tracee,
+                                        __u32 ptrace_mode) {
+  /*
+   * the name (comm) of a process can be set by the process itself, so the
+   * exemption goes by the file it runs. kernel threads have no executable,
+   * and a file the container wrote over the tracer is not exempted
+   */
+  struct inode *exe = BPF_CORE_READ(tracer, mm, exe_file, f_inode);
+  if (exe && !on_upper_layer(exe)) {
+    struct ptrace_exempt key = {
+        .ino = BPF_CORE_READ(exe, i_ino),
+        .dev = BPF_CORE_READ(exe, i_sb, s_dev),
+        .profile_id = policy->profile_id,
+    };
+    if (bpf_map_lookup_elem(&map_ptrace_exempt, &key))
+      return 0;
+  }
+
+  // report the blocked (or in audit mode: allowed) attempt with the tracee
+  struct violation_event *e = reserve_violation(policy, HOOK_ID_PTRACE, mode);
+  if (e) {
+    e->mode = ptrace_mode;
+    bpf_probe_read_kernel_str(e->path, TASK_COMM_LEN, tracee->comm);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+// the current task wants to trace (or read the memory of) child
+SEC("lsm/ptrace_access_check")
+int BPF_PROG(ptrace_access_check, struct task_struct *child,
+             unsigned int ptrace_mode) {
+  if (!(ptrace_mode & PTRACE_MODE_ATTACH))
+    return 0;
+
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_PTRACE);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return check_ptrace(policy, mode, bpf_get_current_task_btf(), child,
+                      ptrace_mode);
+}
+
+// the current task asks to be traced by its parent (PTRACE_TRACEME)
+SEC("lsm/ptrace_traceme")
+int BPF_PROG(ptrace_traceme, struct task_struct *parent) {
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_PTRACE);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  return check_ptrace(policy, mode, parent, bpf_get_current_task_btf(), 0);
+}
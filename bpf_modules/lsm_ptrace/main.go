@@ -0,0 +1,95 @@
+/*
+ * documentation: https://ebpf-go.dev/guides/getting-started/#compile-ebpf-c-and-generate-scaffolding-using-bpf2go
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+const (
+	mapKey    uint32 = 0
+	bpfFSPath        = "/sys/fs/bpf"
+)
+
+func main() {
+	// Remove resource limits for kernels <5.11.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatalf("failed to remove memory lock: %v", err)
+	}
+
+	fn := "maps"
+
+	pinPath := path.Join(bpfFSPath, fn)
+	if err := os.MkdirAll(pinPath, os.ModePerm); err != nil {
+		log.Fatalf("failed to create bpf fs subpath: %+v", err)
+	}
+
+	/*
+	 * Load the compiled eBPF ELF and load it into the kernel.
+	 *
+	 * objs is an instance of the struct lsm_ptraceObjects
+	 * the struct is auto-generated by go generate
+	 * the name of the struct can be seen in the file lsm_ptrace_bpfel.go
+	 * loadLsm_ptraceObjects is a function that loads the programs and maps from the eBPF object file into the kernel
+	 * and assigns them to the provided Go struct (lsm_ptracePrograms or lsm_ptraceMaps)
+	 * objs.Close() is a method of lsm_ptraceObjects struct and unloads the eBPF program from the kernel
+	 * the GO keyword defer ensures that the deferred call's arguments are evaluated immediately,
+	 * but the function call is not executed until the surrounding function returns
+	 */
+	objs := lsm_ptraceObjects{}
+	if err := loadLsm_ptraceObjects(&objs, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: pinPath,
+		},
+	}); err != nil {
+		log.Fatalf("failed to load into the kernel: %v", err)
+	}
+	defer objs.Close()
+	/*
+	 * The link.AttachLSM function attaches the eBPF program to the appropriate LSM hook,
+	 * but it’s the eBPF program itself that determines which LSM hook it is attaching to,
+	 * based on its definition (in this case lsm/ptrace_access_check)
+	 * The LSMOptions struct contains options for how the eBPF program should be attached,
+	 * like which program to attach (the PtraceAccessCheck Program in this case) and any other configuration options.
+	 * accessHook is a variable of type link.Link (from the github.com/cilium/ebpf/link package).
+	 * it represents the connection between the eBPF program and the LSM hook
+	 * it manages the lifecycle of the link with methods such as Close()
+	 * Close() ensures that the link between the eBPF program and the LSM hook (ptrace syscall in this case)
+	 * is properly cleaned up
+	 */
+	accessHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.PtraceAccessCheck,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer accessHook.Close()
+
+	// a tracee can also invite its parent to trace it (PTRACE_TRACEME)
+	tracemeHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.PtraceTraceme,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer tracemeHook.Close()
+
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+	log.Printf("                 successfully loaded lsm_ptrace")
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+
+	// Wait for a signal (e.g. control c) to exit.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	log.Println("Received interrupt, detaching program")
+}
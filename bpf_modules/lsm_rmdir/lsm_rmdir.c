@@ -5,76 +5,162 @@
 #include <bpf/bpf_tracing.h>
 #include <linux/errno.h>
 
+#include "../include_dir/container_policy.h"
+#include "../include_dir/path_rules.h"
+#include "../include_dir/violation_event.h"
+
+// how many parent directories are checked for a protected directory
+#define MAX_PROTECTED_DEPTH 16
+
 char _license[] SEC("license") = "GPL";
 
+/*
+ * a protected directory, identified by the device of its filesystem (the
+ * kernel's s_dev encoding) and its inode number
+ * kernel_spy resolves the protected directories of every container through
+ * /proc/<pid>/root and mirrors this layout in Go, keep both in sync
+ */
+struct protected_inode {
+  __u64 ino;
+  __u32 dev;
+  __u32 _pad;
+};
+
+// protected directories of all containers, the value is unused
 struct {
   __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct protected_inode);
+  __type(value, __u32);
+  __uint(max_entries, 1024);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_protected_inodes SEC(".maps");
+
+/*
+ * protected trees given as path patterns (e.g. "/data/*"), filled by
+ * kernel_spy from the profile configuration
+ * they are matched against the path of the directory that contains the
+ * removed or renamed entry, with a trailing "/" (e.g. "/data/logs/")
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
   __type(key, __u32);
-  __type(value, __u64);
-  __uint(max_entries, 64);
+  __type(value, struct path_rule);
+  __uint(max_entries, MAX_PATH_RULES);
   __uint(pinning, LIBBPF_PIN_BY_NAME);
-} map_container_cgroup_ids SEC(".maps");
+} map_protected_paths SEC(".maps");
 
-SEC("lsm/path_rmdir")
-int BPF_PROG(path_rmdir, const struct path *path, struct dentry *dentry) {
-  __u32 key;
-  __u64 *value;
-  __u64 cgrp_id = bpf_get_current_cgroup_id();
-
-// loop through all cgroup ids
-#pragma unroll
-  for (int i = 0; i < 64; i++) {
-    key = i;
-    value = bpf_map_lookup_elem(&map_container_cgroup_ids, &key);
-    if (!value)
-      continue;
-
-    if (cgrp_id == *value) {
-      bpf_printk("matched cgroup_id %llu in map at key %d → blocking rmdir\n",
-                 cgrp_id, i);
-      return -EPERM;
+/*
+ * returns 1 if dentry or one of its parent directories is a protected
+ * directory
+ */
+static __always_inline int in_protected_tree(struct dentry *dentry) {
+  for (int i = 0; i < MAX_PROTECTED_DEPTH; i++) {
+    if (!dentry)
+      break;
+
+    struct inode *inode = dentry->d_inode;
+    if (inode) {
+      struct protected_inode key = {
+          .ino = inode->i_ino,
+          .dev = inode->i_sb->s_dev,
+      };
+      if (bpf_map_lookup_elem(&map_protected_inodes, &key))
+        return 1;
     }
-  }
 
-  // else allow rmdit
+    // the root directory is its own parent
+    struct dentry *parent = dentry->d_parent;
+    if (parent == dentry)
+      break;
+    dentry = parent;
+  }
   return 0;
 }
 
-////go:build ignore
-//
-///*
-// * add kernel type definitions (e.g. path->dentry->d_parent->d_name.name,
-// * which is the name of the directory in the current path)
-// * how to get this file: bpftool btf dump file /sys/kernel/btf/vmlinux format
-// c
-// * > vmlinux.h
-// */
-// #include "../include_dir/vmlinux.h"
-//// add bpf helper functions (e.g bpf_map_lookup_elem(), bpf_map_update_elem())
-// #include <bpf/bpf_helpers.h>
-// #include <bpf/bpf_tracing.h>
-// #include <linux/errno.h>
-// #include <string.h>
-//
-///*
-// * available LSM hooks: https://www.kernel.org/doc/html/v5.2/security/LSM.html
-// * how to get BPF_PROG function declaration for the path_rmdir LSM hook:
-// * grep path_rmdir oth/X/kernel/linux-6.10/include/linux/lsm_hook_defs.h
-// */
-// SEC("lsm/path_rmdir")
-///*
-// * this program executes whenever a rmdir command is performed
-// * it forbids the deletion of the directory furkan
-// */
-// int BPF_PROG(path_rmdir, const struct path *path, struct dentry *dentry) {
-//  char buf[32];
-//  // read the directory name that is to be removed
-//  bpf_probe_read_str(buf, sizeof(buf), dentry->d_name.name);
-//  if (strncmp(buf, "furkan", 6) == 0) {
-//    bpf_printk("rmdir attempted on the directory: '%s'\n", buf);
-//    return -EPERM;
-//  }
-//  return 0;
-//}
-//
-// char _license[] SEC("license") = "GPL";
+/*
+ * returns 1 if the directory dir (with a trailing "/") matches one of the
+ * protected path patterns of the profile
+ * buf receives the path of dir
+ */
+static __always_inline int in_protected_path(const struct path *dir,
+                                             __u32 profile_id, char *buf) {
+  long len = bpf_d_path((struct path *)dir, buf, PATH_BUF_LEN);
+  // bpf_d_path counts the terminating NUL, leave room for the "/"
+  if (len <= 0 || len >= PATH_BUF_LEN)
+    return 0;
+
+  __u32 path_len = (__u32)(len - 1) & (PATH_BUF_LEN - 1);
+  // "/" is the only path that already ends with a slash
+  if (path_len > 1) {
+    buf[path_len & (PATH_BUF_LEN - 1)] = '/';
+    path_len++;
+    buf[path_len & (PATH_BUF_LEN - 1)] = '\0';
+  }
+
+  return match_path_rules(&map_protected_paths, profile_id, buf,
+                          path_len & (PATH_BUF_LEN - 1)) != 0;
+}
+
+/*
+ * shared by all hooks of this module: deny (or audit) the removal or rename
+ * of dentry in the directory dir if it belongs to a protected tree
+ */
+static __always_inline int check_protected(__u32 hook_id, const struct path *dir,
+                                           struct dentry *dentry) {
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, hook_id);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  char *buf = path_buffer();
+  if (!buf)
+    return 0;
+
+  if (!in_protected_tree(dentry) &&
+      !in_protected_path(dir, policy->profile_id, buf))
+    // everything outside the protected directories may be removed
+    return 0;
+
+  // report the blocked (or in audit mode: allowed) operation
+  struct violation_event *e = reserve_violation(policy, hook_id, mode);
+  if (e) {
+    bpf_probe_read_kernel_str(e->path, sizeof(e->path), dentry->d_name.name);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+SEC("lsm/path_rmdir")
+int BPF_PROG(path_rmdir, const struct path *dir, struct dentry *dentry) {
+  return check_protected(HOOK_ID_RMDIR, dir, dentry);
+}
+
+SEC("lsm/path_unlink")
+int BPF_PROG(path_unlink, const struct path *dir, struct dentry *dentry) {
+  return check_protected(HOOK_ID_UNLINK, dir, dentry);
+}
+
+/*
+ * a protected tree can neither be moved away (old_dentry) nor can something
+ * be moved into it to replace its contents (new_dir)
+ * an existing target (new_dentry) is replaced, or with RENAME_EXCHANGE moved
+ * to the old place, so it must not be protected either
+ */
+SEC("lsm/path_rename")
+int BPF_PROG(path_rename, const struct path *old_dir, struct dentry *old_dentry,
+             const struct path *new_dir, struct dentry *new_dentry,
+             unsigned int flags) {
+  int ret = check_protected(HOOK_ID_RENAME, old_dir, old_dentry);
+  if (ret)
+    return ret;
+
+  if (new_dentry->d_inode) {
+    ret = check_protected(HOOK_ID_RENAME, new_dir, new_dentry);
+    if (ret)
+      return ret;
+  }
+
+  return check_protected(HOOK_ID_RENAME, new_dir, new_dir->dentry);
+}
@@ -66,13 +66,30 @@ func main() {
 	 * Close() ensures that the link between the eBPF program and the LSM hook (chmod syscall in this case)
 	 * is properly cleaned up
 	 */
-	chmodHook, err := link.AttachLSM(link.LSMOptions{
+	rmdirHook, err := link.AttachLSM(link.LSMOptions{
 		Program: objs.PathRmdir,
 	})
 	if err != nil {
 		log.Fatalf("failed to attach to LSM Hook: %v", err)
 	}
-	defer chmodHook.Close()
+	defer rmdirHook.Close()
+
+	// the protected directories also can't be emptied (unlink) or moved away (rename)
+	unlinkHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.PathUnlink,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer unlinkHook.Close()
+
+	renameHook, err := link.AttachLSM(link.LSMOptions{
+		Program: objs.PathRename,
+	})
+	if err != nil {
+		log.Fatalf("failed to attach to LSM Hook: %v", err)
+	}
+	defer renameHook.Close()
 
 	log.Printf("<<<<--------------------------------------------------------->>>>")
 	log.Printf("                 succesfully loaded lsm_rmdir")
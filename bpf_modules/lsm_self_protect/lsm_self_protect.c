@@ -0,0 +1,249 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/violation_event.h"
+
+// macro from the kernel headers, it is not part of vmlinux.h
+#define FMODE_WRITE 0x2
+
+// kinds of bpf objects in struct protected_id
+#define OBJ_MAP 1
+#define OBJ_PROG 2
+#define OBJ_LINK 3
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * unlike the other modules, this one protects john_wick from the host
+ * (everything outside of john_wick's cgroup), not the host from containers
+ * main.go keeps all maps of this module up to date and mirrors the layouts
+ * of the keys in Go, keep both in sync
+ */
+
+/*
+ * cgroups that may modify john_wick's bpf objects and signal its processes,
+ * john_wick's own cgroup and those of authorised management tools
+ * a cgroup also authorises all of its sub-cgroups, the value is unused
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u64);
+  __type(value, __u32);
+  __uint(max_entries, 16);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_self_authorized SEC(".maps");
+
+// the cgroup of john_wick, its processes can't be signaled from outside
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, __u64);
+  __uint(max_entries, 1);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_self_cgroup SEC(".maps");
+
+// a map, program or link that is held by one of john_wick's processes
+struct protected_id {
+  // OBJ_*
+  __u32 type;
+  __u32 id;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct protected_id);
+  __type(value, __u32);
+  __uint(max_entries, 1024);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_self_protected_ids SEC(".maps");
+
+// a pin in the bpf filesystem, same layout as struct protected_inode of lsm_rmdir
+struct protected_pin {
+  __u64 ino;
+  __u32 dev;
+  __u32 _pad;
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct protected_pin);
+  __type(value, __u32);
+  __uint(max_entries, 1024);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_self_protected_pins SEC(".maps");
+
+// returns 1 if the current task runs in an authorised cgroup or below one
+static __always_inline int authorized(void) {
+  __u64 cgrp_id = bpf_get_current_cgroup_id();
+  if (bpf_map_lookup_elem(&map_self_authorized, &cgrp_id))
+    return 1;
+
+  for (int level = 1; level < MAX_CGROUP_LEVEL; level++) {
+    __u64 ancestor_id = bpf_get_current_ancestor_cgroup_id(level);
+    if (!ancestor_id)
+      break;
+    if (bpf_map_lookup_elem(&map_self_authorized, &ancestor_id))
+      return 1;
+  }
+  return 0;
+}
+
+static __always_inline int is_protected(__u32 type, __u32 id) {
+  struct protected_id key = {
+      .type = type,
+      .id = id,
+  };
+  return bpf_map_lookup_elem(&map_self_protected_ids, &key) != NULL;
+}
+
+// the mode of the whole module, self protection can be switched to audit or off
+static __always_inline __u32 self_protect_mode(void) {
+  __u32 hook_id = HOOK_ID_SELF_PROTECT;
+  __u32 *mode = bpf_map_lookup_elem(&map_policy_modes, &hook_id);
+  return mode ? *mode : MODE_ENFORCE;
+}
+
+/*
+ * report the blocked (or in audit mode: allowed) operation and return the
+ * verdict, there is no container policy so the event carries the cgroup of
+ * the current task
+ */
+static __always_inline int deny_self(__u32 mode, const char *what,
+                                     __u32 detail) {
+  struct violation_event *e =
+      reserve_violation(NULL, HOOK_ID_SELF_PROTECT, mode);
+  if (e) {
+    e->cgroup_id = bpf_get_current_cgroup_id();
+    e->mode = detail;
+    if (what)
+      bpf_probe_read_kernel_str(e->path, sizeof(e->path), what);
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+/*
+ * links are only held as file descriptors by john_wick's processes, the only
+ * way to detach or replace one from outside is to fetch it by its id
+ */
+SEC("lsm/bpf")
+int BPF_PROG(bpf_syscall, int cmd, union bpf_attr *attr, unsigned int size) {
+  if (cmd != BPF_LINK_GET_FD_BY_ID)
+    return 0;
+
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+  if (!is_protected(OBJ_LINK, attr->link_id))
+    return 0;
+
+  return deny_self(mode, "link", attr->link_id);
+}
+
+/*
+ * a file descriptor of a map is handed out (BPF_OBJ_GET of a pin,
+ * BPF_MAP_GET_FD_BY_ID), e.g. by bpftool map update
+ * read-only access stays possible, so the maps can still be dumped
+ */
+SEC("lsm/bpf_map")
+int BPF_PROG(bpf_map, struct bpf_map *map, fmode_t fmode) {
+  if (!(fmode & FMODE_WRITE))
+    return 0;
+
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+  if (!is_protected(OBJ_MAP, map->id))
+    return 0;
+
+  return deny_self(mode, map->name, map->id);
+}
+
+// a file descriptor of a program is handed out, it could be used to detach it
+SEC("lsm/bpf_prog")
+int BPF_PROG(bpf_prog, struct bpf_prog *prog) {
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+  if (!is_protected(OBJ_PROG, prog->aux->id))
+    return 0;
+
+  return deny_self(mode, prog->aux->name, prog->aux->id);
+}
+
+// returns 1 if dentry is one of the pins below /sys/fs/bpf/maps
+static __always_inline int is_protected_pin(struct dentry *dentry) {
+  struct inode *inode = dentry->d_inode;
+  if (!inode)
+    return 0;
+
+  struct protected_pin key = {
+      .ino = inode->i_ino,
+      .dev = inode->i_sb->s_dev,
+  };
+  return bpf_map_lookup_elem(&map_self_protected_pins, &key) != NULL;
+}
+
+// rm of a pin below /sys/fs/bpf/maps
+SEC("lsm/inode_unlink")
+int BPF_PROG(inode_unlink, struct inode *dir, struct dentry *dentry) {
+  if (!is_protected_pin(dentry))
+    return 0;
+
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+
+  return deny_self(mode, (const char *)dentry->d_name.name, 0);
+}
+
+/*
+ * mv of a pin, or onto one: either way the name of the pin would be free for
+ * a map of someone else, which john_wick would then open by its path
+ */
+SEC("lsm/inode_rename")
+int BPF_PROG(inode_rename, struct inode *old_dir, struct dentry *old_dentry,
+             struct inode *new_dir, struct dentry *new_dentry) {
+  struct dentry *pin = NULL;
+  if (is_protected_pin(old_dentry))
+    pin = old_dentry;
+  else if (is_protected_pin(new_dentry))
+    pin = new_dentry;
+  if (!pin)
+    return 0;
+
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+
+  return deny_self(mode, (const char *)pin->d_name.name, 0);
+}
+
+// kill(2), tgkill(2), ... to one of john_wick's processes
+SEC("lsm/task_kill")
+int BPF_PROG(task_kill, struct task_struct *p, struct kernel_siginfo *info,
+             int sig, const struct cred *cred) {
+  // signal 0 only checks whether the process exists
+  if (!sig)
+    return 0;
+
+  __u32 zero = 0;
+  __u64 *self_cgroup = bpf_map_lookup_elem(&map_self_cgroup, &zero);
+  if (!self_cgroup || !*self_cgroup)
+    return 0;
+  if (BPF_CORE_READ(p, cgroups, dfl_cgrp, kn, id) != *self_cgroup)
+    return 0;
+
+  __u32 mode = self_protect_mode();
+  if (mode == MODE_OFF || authorized())
+    return 0;
+
+  return deny_self(mode, p->comm, sig);
+}
@@ -0,0 +1,295 @@
+/*
+ * documentation: https://ebpf-go.dev/guides/getting-started/#compile-ebpf-c-and-generate-scaffolding-using-bpf2go
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	bpfFSPath    = "/sys/fs/bpf"
+	cgroupFSPath = "/sys/fs/cgroup"
+	// cgroup of systemd (pid 1), it stops john_wick's service with signals
+	initCgroup = "/init.scope"
+)
+
+// kinds of bpf objects, the values have to match the OBJ_* defines in lsm_self_protect.c
+const (
+	objMap  uint32 = 1
+	objProg uint32 = 2
+	objLink uint32 = 3
+)
+
+// key of map_self_protected_ids, the layout has to match struct protected_id in lsm_self_protect.c
+type protectedID struct {
+	Type uint32
+	ID   uint32
+}
+
+// key of map_self_protected_pins, the layout has to match struct protected_pin in lsm_self_protect.c
+type protectedPin struct {
+	Ino uint64
+	Dev uint32
+	_   uint32
+}
+
+/*
+ * Return the path of the cgroup the process runs in (relative to the cgroup v2 mount),
+ * e.g. "/system.slice/john_wick.service".
+ */
+func cgroupPath(pid string) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%s/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	// cgroup v2 has a single line starting with "0::"
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "0::"); ok {
+			return rest, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/%s/cgroup", pid)
+}
+
+// the cgroup id is the inode number of the cgroup's directory
+func cgroupID(cgroup string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path.Join(cgroupFSPath, cgroup), &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ino, nil
+}
+
+/*
+ * Collect the ids of every map, program and link the processes of the cgroup hold.
+ * /proc/<pid>/fdinfo/<fd> of a bpf file descriptor contains lines like "map_id: 12",
+ * "prog_id: 34" and "link_id: 5".
+ */
+func heldObjects(cgroup string) map[protectedID]struct{} {
+	ids := make(map[protectedID]struct{})
+
+	procs, err := os.ReadFile(path.Join(cgroupFSPath, cgroup, "cgroup.procs"))
+	if err != nil {
+		log.Printf("Could not read processes of %s: %v", cgroup, err)
+		return ids
+	}
+
+	for _, pid := range strings.Fields(string(procs)) {
+		fdinfos, err := filepath.Glob(fmt.Sprintf("/proc/%s/fdinfo/*", pid))
+		if err != nil {
+			continue
+		}
+		for _, fdinfo := range fdinfos {
+			f, err := os.Open(fdinfo)
+			if err != nil {
+				// the process exited or closed the file descriptor
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				key, value, ok := strings.Cut(scanner.Text(), ":")
+				if !ok {
+					continue
+				}
+				var kind uint32
+				switch key {
+				case "map_id":
+					kind = objMap
+				case "prog_id":
+					kind = objProg
+				case "link_id":
+					kind = objLink
+				default:
+					continue
+				}
+				id, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+				if err == nil {
+					ids[protectedID{Type: kind, ID: uint32(id)}] = struct{}{}
+				}
+			}
+			f.Close()
+		}
+	}
+	return ids
+}
+
+// every pin below dir (e.g. /sys/fs/bpf/maps)
+func pins(dir string) map[protectedPin]struct{} {
+	found := make(map[protectedPin]struct{})
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Stat(p, &stat); err != nil {
+			return nil
+		}
+		found[protectedPin{
+			Ino: stat.Ino,
+			// the kernel stores the device as MKDEV(major, minor) = major << 20 | minor
+			Dev: unix.Major(uint64(stat.Dev))<<20 | unix.Minor(uint64(stat.Dev)),
+		}] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not walk %s: %v", dir, err)
+	}
+	return found
+}
+
+// bring a map whose values are unused in line with the desired set of keys
+func writeKeySet[K comparable](m *ebpf.Map, desired map[K]struct{}) {
+	current := make(map[K]struct{})
+	var key K
+	var value uint32
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		current[key] = struct{}{}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Could not read eBPF map: %v", err)
+		return
+	}
+
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				log.Printf("Failed to delete %+v from eBPF map: %v", key, err)
+			}
+		}
+	}
+	for key := range desired {
+		if _, ok := current[key]; !ok {
+			if err := m.Update(key, uint32(1), ebpf.UpdateAny); err != nil {
+				log.Printf("Failed to add %+v to eBPF map: %v", key, err)
+			}
+		}
+	}
+}
+
+func main() {
+	// cgroups of management tools that may modify john_wick's maps, e.g. /system.slice/manager.service
+	authorizedFlag := flag.String("authorized-cgroups", "", "comma separated cgroup paths that are allowed to modify the maps")
+	flag.Parse()
+
+	// Remove resource limits for kernels <5.11.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatalf("failed to remove memory lock: %v", err)
+	}
+
+	fn := "maps"
+
+	pinPath := path.Join(bpfFSPath, fn)
+	if err := os.MkdirAll(pinPath, os.ModePerm); err != nil {
+		log.Fatalf("failed to create bpf fs subpath: %+v", err)
+	}
+
+	/*
+	 * this module is spawned by john_wick, so its own cgroup is john_wick's cgroup
+	 * run john_wick in a cgroup of its own (e.g. as a systemd service), every process in it
+	 * is authorized and protected
+	 */
+	selfCgroup, err := cgroupPath("self")
+	if err != nil {
+		log.Fatalf("failed to read own cgroup: %v", err)
+	}
+	selfID, err := cgroupID(selfCgroup)
+	if err != nil {
+		log.Fatalf("failed to stat own cgroup %s: %v", selfCgroup, err)
+	}
+
+	authorizedIDs := map[uint64]struct{}{selfID: {}}
+	// without it, systemctl stop could not stop john_wick when it runs as a systemd service
+	if id, err := cgroupID(initCgroup); err == nil {
+		authorizedIDs[id] = struct{}{}
+	}
+	if *authorizedFlag != "" {
+		for _, cgroup := range strings.Split(*authorizedFlag, ",") {
+			id, err := cgroupID(cgroup)
+			if err != nil {
+				log.Fatalf("failed to stat authorized cgroup %s: %v", cgroup, err)
+			}
+			authorizedIDs[id] = struct{}{}
+		}
+	}
+
+	objs := lsm_self_protectObjects{}
+	if err := loadLsm_self_protectObjects(&objs, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: pinPath,
+		},
+	}); err != nil {
+		log.Fatalf("failed to load into the kernel: %v", err)
+	}
+	defer objs.Close()
+
+	// authorize before attaching, otherwise john_wick would lock itself out
+	writeKeySet(objs.MapSelfAuthorized, authorizedIDs)
+	if err := objs.MapSelfCgroup.Update(uint32(0), selfID, ebpf.UpdateAny); err != nil {
+		log.Fatalf("failed to write own cgroup id: %v", err)
+	}
+
+	programs := []*ebpf.Program{
+		objs.BpfSyscall,
+		objs.BpfMap,
+		objs.BpfProg,
+		objs.InodeUnlink,
+		objs.InodeRename,
+		objs.TaskKill,
+	}
+	for _, prog := range programs {
+		hook, err := link.AttachLSM(link.LSMOptions{
+			Program: prog,
+		})
+		if err != nil {
+			log.Fatalf("failed to attach to LSM Hook: %v", err)
+		}
+		defer hook.Close()
+	}
+
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+	log.Printf("              successfully loaded lsm_self_protect")
+	log.Printf("<<<<--------------------------------------------------------->>>>")
+
+	// Wait for a signal (e.g. control c) to exit.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+
+	/*
+	 * modules are started and restarted independently, so the protected objects are
+	 * collected again every few seconds
+	 */
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		writeKeySet(objs.MapSelfProtectedIds, heldObjects(selfCgroup))
+		writeKeySet(objs.MapSelfProtectedPins, pins(pinPath))
+
+		select {
+		case <-sig:
+			log.Println("Received interrupt, detaching program")
+			return
+		case <-ticker.C:
+		}
+	}
+}
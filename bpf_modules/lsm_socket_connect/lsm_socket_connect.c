@@ -0,0 +1,186 @@
+//go:build ignore
+
+#include "../include_dir/vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <linux/errno.h>
+
+#include "../include_dir/container_policy.h"
+#include "../include_dir/violation_event.h"
+
+// macros from the kernel headers, they are not part of vmlinux.h
+#define AF_INET 2
+#define AF_INET6 10
+// sizeof(struct sockaddr_in6) without sin6_scope_id
+#define SIN6_LEN_RFC2133 24
+
+// port ranges per destination, see struct connect_rule
+#define MAX_CONNECT_PORTS 8
+
+char _license[] SEC("license") = "GPL";
+
+/*
+ * key of map_connect_rules
+ * IPv4 addresses are stored as IPv4-mapped IPv6 addresses (::ffff:a.b.c.d),
+ * so one trie holds both families. prefixlen counts the bits of profile_id
+ * plus the bits of the address, a rule always matches its whole profile id
+ */
+struct connect_key {
+  __u32 prefixlen;
+  __u32 profile_id;
+  __u8 addr[16];
+};
+
+// a port range of a destination, a rule with action 0 marks an unused slot
+struct connect_port {
+  // host byte order, inclusive
+  __u16 first;
+  __u16 last;
+  // IPPROTO_*, 0 matches every protocol
+  __u8 proto;
+  // CONNECT_*
+  __u8 action;
+  __u16 _pad;
+};
+
+/*
+ * rules of one destination CIDR, the first port range that matches decides
+ * kernel_spy mirrors the layout of the key and the value in Go, keep both in
+ * sync
+ */
+struct connect_rule {
+  struct connect_port ports[MAX_CONNECT_PORTS];
+};
+
+/*
+ * destination CIDRs of all profiles, filled by kernel_spy from the profile
+ * configuration
+ * only the most specific CIDR is looked up, if none of its port ranges
+ * match the connect falls back to container_policy.connect_default
+ */
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __type(key, struct connect_key);
+  __type(value, struct connect_rule);
+  __uint(max_entries, 1024);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} map_connect_rules SEC(".maps");
+
+// return the CONNECT_* action of the rule that matches port and protocol
+static __always_inline __u32 rule_action(struct connect_rule *rule, __u16 port,
+                                         __u8 proto, __u32 fallback) {
+  for (int i = 0; i < MAX_CONNECT_PORTS; i++) {
+    struct connect_port *p = &rule->ports[i];
+    if (!p->action)
+      break;
+    if (p->proto && p->proto != proto)
+      continue;
+    if (port < p->first || port > p->last)
+      continue;
+    return p->action;
+  }
+  return fallback;
+}
+
+/*
+ * check the destination address of a connect or a send against the rules of
+ * the container and return the verdict
+ */
+static __always_inline int check_destination(struct socket *sock,
+                                             struct sockaddr *address,
+                                             int addrlen) {
+  // the container of the current task, also found from its sub-cgroups
+  struct container_policy *policy = lookup_container_policy();
+  __u32 mode = policy_mode(policy, HOOK_ID_SOCKET_CONNECT);
+  if (!policy || mode == MODE_OFF)
+    return 0;
+
+  struct connect_key key = {
+      .profile_id = policy->profile_id,
+  };
+  __u16 family = 0;
+  __u16 port = 0;
+  bpf_probe_read_kernel(&family, sizeof(family), &address->sa_family);
+
+  if (family == AF_INET) {
+    struct sockaddr_in sin = {};
+    if (addrlen < (int)sizeof(sin))
+      return 0;
+    bpf_probe_read_kernel(&sin, sizeof(sin), address);
+    key.prefixlen = 32 + 128;
+    key.addr[10] = 0xff;
+    key.addr[11] = 0xff;
+    __builtin_memcpy(&key.addr[12], &sin.sin_addr, 4);
+    port = bpf_ntohs(sin.sin_port);
+  } else if (family == AF_INET6) {
+    struct sockaddr_in6 sin6 = {};
+    /*
+     * the kernel also accepts the RFC 2133 layout without sin6_scope_id,
+     * shorter addresses are rejected by the kernel itself
+     */
+    if (addrlen < SIN6_LEN_RFC2133)
+      return 0;
+    bpf_probe_read_kernel(&sin6, SIN6_LEN_RFC2133, address);
+    key.prefixlen = 32 + 128;
+    __builtin_memcpy(key.addr, &sin6.sin6_addr, 16);
+    port = bpf_ntohs(sin6.sin6_port);
+  } else {
+    // unix sockets, netlink, AF_UNSPEC (disconnect of a udp socket), ...
+    return 0;
+  }
+
+  __u8 proto = (__u8)BPF_CORE_READ(sock, sk, sk_protocol);
+
+  __u32 action = policy->connect_default;
+  struct connect_rule *rule = bpf_map_lookup_elem(&map_connect_rules, &key);
+  if (rule)
+    action = rule_action(rule, port, proto, action);
+
+  if (action != CONNECT_DENY)
+    return 0;
+
+  // report the blocked (or in audit mode: allowed) connect with its destination
+  struct violation_event *e =
+      reserve_violation(policy, HOOK_ID_SOCKET_CONNECT, mode);
+  if (e) {
+    e->mode = proto;
+    __u64 args[2] = {(__u64)&key.addr[12], port};
+    if (family == AF_INET) {
+      bpf_snprintf(e->path, sizeof(e->path), "%pI4:%u", args, sizeof(args));
+    } else {
+      args[0] = (__u64)key.addr;
+      bpf_snprintf(e->path, sizeof(e->path), "[%pI6]:%u", args, sizeof(args));
+    }
+    bpf_ringbuf_submit(e, 0);
+  }
+
+  return mode_verdict(mode);
+}
+
+/*
+ * checks every connect() of a container, independent of how the container
+ * is attached to the network (bridge, host or macvlan network)
+ */
+SEC("lsm/socket_connect")
+int BPF_PROG(socket_connect, struct socket *sock, struct sockaddr *address,
+             int addrlen) {
+  return check_destination(sock, address, addrlen);
+}
+
+/*
+ * sendto()/sendmsg() with a destination address, e.g. a dns query over an
+ * unconnected udp socket never calls connect(). the address was already
+ * copied into the kernel, msg_name is NULL on connected sockets, their
+ * destination was checked by socket_connect
+ */
+SEC("lsm/socket_sendmsg")
+int BPF_PROG(socket_sendmsg, struct socket *sock, struct msghdr *msg,
+             int size) {
+  struct sockaddr *address = BPF_CORE_READ(msg, msg_name);
+  if (!address)
+    return 0;
+  return check_destination(sock, address, BPF_CORE_READ(msg, msg_namelen));
+}
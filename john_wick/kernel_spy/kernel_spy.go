@@ -3,11 +3,18 @@ package kernel_spy
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"john_wick/profiles"
+
 	"github.com/cilium/ebpf"
 	"github.com/docker/docker/client"
 	_ "modernc.org/sqlite"
@@ -15,7 +22,118 @@ import (
 
 const mapPath = "/sys/fs/bpf/maps/map_container_cgroup_ids"
 
-func get_cgroupDIR_inode_number(containerIDs []string) map[string]uint64 {
+// hook id -> enforcement mode of that hook for all containers
+const modesMapPath = "/sys/fs/bpf/maps/map_policy_modes"
+
+// mount point of the cgroup v2 hierarchy on the host
+const cgroupFSPath = "/sys/fs/cgroup"
+
+/*
+ * value of map_container_cgroup_ids (the key is the cgroup id)
+ * the layout has to match struct container_policy in
+ * bpf_modules/include_dir/container_policy.h
+ */
+type containerPolicy struct {
+	ProfileID      uint32
+	Hooks          uint32
+	Audit          uint32
+	Level          uint32
+	CgroupID       uint64
+	ChmodDeny      uint32
+	ExecFlags      uint32
+	ConnectDefault uint32
+	_              uint32
+}
+
+// everything kernel_spy needs to know about a running container
+type containerInfo struct {
+	CgroupID uint64
+	// process id of the container's init process
+	Pid int
+	// depth of the container's cgroup below the root cgroup (level 0)
+	Level  uint32
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+// a container that kernel_spy has written into the bpf map
+type Container struct {
+	ID   string
+	Name string
+}
+
+/*
+ * cgroup id -> container of the entries written in the last iteration
+ * read by other goroutines (e.g. to enrich violation events) through LookupContainer
+ */
+var (
+	knownContainersMu sync.RWMutex
+	knownContainers   = make(map[uint64]Container)
+)
+
+// return the container that owns the given cgroup id
+func LookupContainer(cgroupID uint64) (Container, bool) {
+	knownContainersMu.RLock()
+	defer knownContainersMu.RUnlock()
+	c, ok := knownContainers[cgroupID]
+	return c, ok
+}
+
+// translate a profile into the value the bpf programs read
+func policyFromProfile(p *profiles.Profile, info containerInfo) containerPolicy {
+	return containerPolicy{
+		ProfileID:      p.ID,
+		Hooks:          p.HookMask,
+		Audit:          p.AuditMask,
+		Level:          info.Level,
+		CgroupID:       info.CgroupID,
+		ChmodDeny:      p.ChmodMask,
+		ExecFlags:      p.ExecFlags,
+		ConnectDefault: p.ConnectDefault,
+	}
+}
+
+/*
+ * Compute the level of the container's cgroup (the one with the inode cgroupID).
+ * /proc/<pid>/cgroup holds the path of the cgroup the process runs in, e.g.
+ * "0::/system.slice/docker-<id>.scope" -> level 2.
+ * The process may already sit in a sub-cgroup of its container (e.g. systemd moves itself into
+ * /init.scope), so walk up that path until the directory with the container's inode is found.
+ */
+func cgroupLevel(pid int, cgroupID uint64) (uint32, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// cgroup v2 has a single line starting with "0::"
+	var cgroupPath string
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "0::"); ok {
+			cgroupPath = rest
+			break
+		}
+	}
+	if cgroupPath == "" {
+		return 0, fmt.Errorf("no cgroup v2 entry in /proc/%d/cgroup", pid)
+	}
+
+	for p := path.Clean(cgroupPath); ; p = path.Dir(p) {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(path.Join(cgroupFSPath, p), &stat); err == nil && stat.Ino == cgroupID {
+			if p == "/" {
+				return 0, nil
+			}
+			return uint32(strings.Count(p, "/")), nil
+		}
+		if p == "/" {
+			return 0, fmt.Errorf("cgroup %d is not an ancestor of %s", cgroupID, cgroupPath)
+		}
+	}
+}
+
+func get_cgroupDIR_inode_number(containerIDs []string) map[string]containerInfo {
 	// establish docker client
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
@@ -23,8 +141,8 @@ func get_cgroupDIR_inode_number(containerIDs []string) map[string]uint64 {
 	}
 	defer cli.Close()
 
-	// make a Go map to store inode numbers
-	cgroup_directory_inodes := make(map[string]uint64)
+	// make a Go map to store inode numbers (and the metadata profiles are assigned by)
+	cgroup_directory_inodes := make(map[string]containerInfo)
 
 	// get background context, necessary for functions like cli.ContainerInspect()
 	ctx := context.Background()
@@ -56,8 +174,25 @@ func get_cgroupDIR_inode_number(containerIDs []string) map[string]uint64 {
 			continue
 		}
 
+		// the bpf programs also need the level to match tasks in sub-cgroups of the container
+		level, err := cgroupLevel(inspect.State.Pid, stat.Ino)
+		if err != nil {
+			log.Printf("Could not compute cgroup level of container %s: %v", containerID_slice[:12], err)
+			continue
+		}
+
 		// store inode into map
-		cgroup_directory_inodes[containerID_slice] = stat.Ino
+		info := containerInfo{
+			CgroupID: stat.Ino,
+			Pid:      inspect.State.Pid,
+			Level:    level,
+			Name:     strings.TrimPrefix(inspect.Name, "/"),
+		}
+		if inspect.Config != nil {
+			info.Image = inspect.Config.Image
+			info.Labels = inspect.Config.Labels
+		}
+		cgroup_directory_inodes[containerID_slice] = info
 	}
 
 	/*
@@ -97,14 +232,142 @@ func readFilteredLogsDB() ([]string, error) {
 	return ids, nil
 }
 
+/*
+ * read every entry that is currently stored in the pinned map
+ * after a restart of kernel_spy this is the state left behind by the previous run
+ */
+func readPinnedEntries(pinnedMap *ebpf.Map) (map[uint64]containerPolicy, error) {
+	entries := make(map[uint64]containerPolicy)
+
+	var cgroupID uint64
+	var policy containerPolicy
+	iter := pinnedMap.Iterate()
+	for iter.Next(&cgroupID, &policy) {
+		entries[cgroupID] = policy
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterating pinned map: %w", err)
+	}
+	return entries, nil
+}
+
+/*
+ * Bring the pinned map in line with the desired cgroup id -> policy entries.
+ * - deletes every key that is not desired (left over from removed containers or a previous run)
+ * - writes every desired entry that is missing or differs
+ * A full map is reported instead of failing silently.
+ */
+func reconcilePinnedMap(pinnedMap *ebpf.Map, desired map[uint64]containerPolicy, owners map[uint64]Container) {
+	current, err := readPinnedEntries(pinnedMap)
+	if err != nil {
+		log.Printf("Could not read pinned eBPF map: %v", err)
+		return
+	}
+
+	// delete first, so stale entries free up space for new ones
+	for cgroupID := range current {
+		if _, ok := desired[cgroupID]; ok {
+			continue
+		}
+		if err := pinnedMap.Delete(cgroupID); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete stale cgroup id %d from eBPF map: %v", cgroupID, err)
+			continue
+		}
+		log.Printf("Removed stale cgroup id %d from eBPF map", cgroupID)
+	}
+
+	if maxEntries := pinnedMap.MaxEntries(); uint32(len(desired)) > maxEntries {
+		log.Printf("eBPF map is full: %d containers are observed but only %d fit, some containers stay unprotected", len(desired), maxEntries)
+	}
+
+	for cgroupID, policy := range desired {
+		if old, ok := current[cgroupID]; ok && old == policy {
+			continue
+		}
+		containerID := owners[cgroupID].ID
+		if err := pinnedMap.Update(cgroupID, policy, ebpf.UpdateAny); err != nil {
+			// E2BIG: the hash map has no free slot left for a new key
+			if errors.Is(err, syscall.E2BIG) {
+				log.Printf("eBPF map is full, container %s (cgroup id %d) is not protected", containerID[:12], cgroupID)
+			} else {
+				log.Printf("Failed to update eBPF map for container %s: %v", containerID[:12], err)
+			}
+			continue
+		}
+		log.Printf("Updated eBPF map: [%d] -> profile: %d, hooks: %#x, audit: %#x, level: %d | container id: %s", cgroupID, policy.ProfileID, policy.Hooks, policy.Audit, policy.Level, containerID[:12])
+	}
+}
+
+/*
+ * write the mode of every hook into map_policy_modes
+ * the bpf programs read it on every call, so a switch between enforce, audit and off
+ * applies immediately without reloading any program
+ */
+func updatePolicyModes(modesMap *ebpf.Map, modes map[uint32]uint32) {
+	for hookID, mode := range modes {
+		var current uint32
+		if err := modesMap.Lookup(hookID, &current); err == nil && current == mode {
+			continue
+		}
+		if err := modesMap.Update(hookID, mode, ebpf.UpdateAny); err != nil {
+			log.Printf("Failed to set mode of hook %d: %v", hookID, err)
+			continue
+		}
+		log.Printf("Set mode of hook %d to %d", hookID, mode)
+	}
+}
+
+// write the deepest cgroup level the bpf programs search into its slot of map_policy_modes
+func updateCgroupLevel(modesMap *ebpf.Map, level uint32) {
+	var current uint32
+	if err := modesMap.Lookup(profiles.SlotCgroupLevel, &current); err == nil && current == level {
+		return
+	}
+	if err := modesMap.Update(profiles.SlotCgroupLevel, level, ebpf.UpdateAny); err != nil {
+		log.Printf("Failed to set cgroup level: %v", err)
+		return
+	}
+	log.Printf("Set cgroup level to %d", level)
+}
+
+// a key/value pair of map_container_cgroup_ids
+type containerEntry struct {
+	CgroupID  uint64
+	Policy    containerPolicy
+	Container Container
+}
+
 func GetContainerCgroupIDs() {
 	pinnedMap, err := ebpf.LoadPinnedMap(mapPath, &ebpf.LoadPinOptions{})
 	if err != nil {
 		log.Fatalf("Failed to open pinned eBPF map: %v", err)
 	}
 
-	var current_bpf_map_entries = make(map[string]uint32)
-	var index uint32 = 0
+	modesMap, err := ebpf.LoadPinnedMap(modesMapPath, &ebpf.LoadPinOptions{})
+	if err != nil {
+		log.Fatalf("Failed to open pinned eBPF map: %v", err)
+	}
+
+	// rule maps of single modules, written whenever the module is loaded
+	fileRules := &moduleMap{path: fileRulesMapPath}
+	chmodRules := &moduleMap{path: chmodRulesMapPath}
+	protectedInodes := &moduleMap{path: protectedInodesMapPath}
+	protectedPaths := &moduleMap{path: protectedPathsMapPath}
+	execInodes := &moduleMap{path: execInodesMapPath}
+	execRules := &moduleMap{path: execRulesMapPath}
+	connectRules := &moduleMap{path: connectRulesMapPath}
+	ptraceExempt := &moduleMap{path: ptraceExemptMapPath}
+	mountFSTypes := &moduleMap{path: mountFSTypesMapPath}
+
+	// the pinned map survives restarts of kernel_spy, report what the previous run left behind
+	if previous, err := readPinnedEntries(pinnedMap); err != nil {
+		log.Printf("Could not read pinned eBPF map: %v", err)
+	} else if len(previous) > 0 {
+		log.Printf("Found %d entries from a previous run in the eBPF map, reconciling", len(previous))
+	}
+
+	// container id -> last known cgroup id and policy, only used while a container's cgroup can't be looked up
+	lastEntries := make(map[string]containerEntry)
 
 	// infinite loop
 	for {
@@ -116,82 +379,95 @@ func GetContainerCgroupIDs() {
 			continue
 		}
 
-		/*
-		 * the keys in presentIDs are container ids of the type string
-		 * the values of this Go map are all empty structs
-		 * -> it only matters IF this map has an entry at that specified key, not what its value is at that key
-		 */
-		presentIDs := make(map[string]struct{})
-		for _, id := range containerIDs {
-			presentIDs[id] = struct{}{}
+		// profiles are re-read every iteration, so edits to profiles.json apply without a restart
+		profileCfg, err := profiles.Load(profiles.ConfigPath)
+		if err != nil {
+			log.Printf("Could not load profiles, using built-in profiles: %v", err)
+			profileCfg = profiles.Defaults()
 		}
+		updatePolicyModes(modesMap, profileCfg.HookModes())
+		updateCgroupLevel(modesMap, profileCfg.MaxCgroupLevel())
+		writePathRules(fileRules, profileCfg.CompiledFileRules())
+		writePathRules(chmodRules, profileCfg.CompiledChmodRules())
+		writePathRules(protectedPaths, profileCfg.CompiledProtectedPaths())
+		writePathRules(execRules, profileCfg.CompiledExecRules())
+		writeConnectRules(connectRules, profileCfg.CompiledConnectRules())
+		writeKeySet(mountFSTypes, mountAllowlist(profileCfg))
 
 		// get cgroup ids of running containers
 		cgroupMap := get_cgroupDIR_inode_number(containerIDs)
 
+		// the complete state the bpf map should have after this iteration
+		desired := make(map[uint64]containerPolicy)
+		// cgroup id -> container, for log messages and LookupContainer
+		owners := make(map[uint64]Container)
+		// protected directories of all running containers
+		protected := make(map[protectedInode]struct{})
+		// listed executables of all running containers
+		executables := make(map[execInode]struct{})
+		// exempted tracers of all running containers
+		tracers := make(map[exemptTracer]struct{})
+
 		// nth_containerID is the current container being processed in this iteration, it's a single value of type string
 		// the underscore (_) discards the index
 		for _, nth_containerID := range containerIDs {
 			// check if a cgroup inode (cgroup ID) is available for this container id
-			cgroupID, ok := cgroupMap[nth_containerID]
+			info, ok := cgroupMap[nth_containerID]
 			// ok is a bool that returns true if the string nth_containerID led to a cgroup id
 			if !ok {
-				continue
 				/*
 				 * if no cgroup id was found:
 				 * -> container id is still saved in filtered_logs database
 				 * -> container stopped running (exit) but was not removed (with docker rm)
 				 * -> process id is 0 and the code line "cgroupPath := fmt.Sprintf("/proc/%d/root/sys/fs/cgroup", inspect.State.Pid)" does not work
 				 * -> cgroup still exists though but is not retrievable through my function
+				 * keep the last known entry until the container is gone from filtered_logs
 				 */
+				if last, ok := lastEntries[nth_containerID]; ok {
+					desired[last.CgroupID] = last.Policy
+					owners[last.CgroupID] = last.Container
+				}
+				continue
 			}
 
-			/*
-			 * current_bpf_map_entries looks like this:
-			 * current_bpf_map_entries = {
-			 *   "abc123": 0,
-			 *   "def456": 1,
-			 * }
-			 * it's a map that holds keys
-			 * container ids are the respective indices
-			 * if a lookup in this Go map with the nth_containerID returns nothing (exists == false)
-			 * then create a key
-			 * increment index for the next loop iteration
-			 */
-			key, exists := current_bpf_map_entries[nth_containerID]
-			if !exists {
-				key = index
-				index++
+			// the profile decides which hooks apply to this container
+			profile := profileCfg.Resolve(profiles.Container{
+				Name:   info.Name,
+				Image:  info.Image,
+				Labels: info.Labels,
+			})
+			desired[info.CgroupID] = policyFromProfile(profile, info)
+			if info.Level > profileCfg.MaxCgroupLevel() {
+				log.Printf("Cgroup of container %s is at level %d, deeper than cgroup_level %d: tasks in its sub-cgroups are not matched",
+					nth_containerID[:12], info.Level, profileCfg.MaxCgroupLevel())
 			}
-
-			// update bpf map
-			if err := pinnedMap.Update(key, cgroupID, ebpf.UpdateAny); err != nil {
-				log.Printf("Failed to update eBPF map for container %s: %v", nth_containerID[:12], err)
-				continue
+			for _, inode := range resolveProtectedInodes(info.Pid, profile.ProtectedInodes) {
+				protected[inode] = struct{}{}
 			}
-
-			// save the key if it was just created
-			// this line does nothing if the key already existed
-			current_bpf_map_entries[nth_containerID] = key
-
-			log.Printf("Updated eBPF map: [%d] -> cgroup inode: %d | container id: %s", key, cgroupID, nth_containerID[:12])
+			for _, inode := range resolveExecInodes(info.Pid, profile.ID, profile.ExecInodes) {
+				executables[inode] = struct{}{}
+			}
+			for _, inode := range resolvePtraceExempt(info.Pid, profile.ID, profile.PtraceInodes) {
+				tracers[inode] = struct{}{}
+			}
+			owners[info.CgroupID] = Container{ID: nth_containerID, Name: info.Name}
 		}
 
-		// remove entries that are no longer in filtered_logs database
-		for nth_containerID, key := range current_bpf_map_entries {
-			// -> does the lookup return something? if yes, then stillPresent == true. if not, then stillPresent == false
-			// also discard the value of the lookup (_), since it is only an empty struct
-			if _, stillPresent := presentIDs[nth_containerID]; !stillPresent {
-				if err := pinnedMap.Delete(key); err != nil {
-					log.Printf("Failed to delete key %d for container %s: %v", key, nth_containerID[:12], err)
-				} else {
-					log.Printf("Removed key %d (container %s) from eBPF map", key, nth_containerID[:12])
-				}
-				// also delete the container id from the Go map
-				delete(current_bpf_map_entries, nth_containerID)
-			}
+		// forget containers that are no longer in filtered_logs database
+		lastEntries = make(map[string]containerEntry, len(owners))
+		for cgroupID, c := range owners {
+			lastEntries[c.ID] = containerEntry{CgroupID: cgroupID, Policy: desired[cgroupID], Container: c}
 		}
 
+		reconcilePinnedMap(pinnedMap, desired, owners)
+		writeKeySet(protectedInodes, protected)
+		writeKeySet(execInodes, executables)
+		writeKeySet(ptraceExempt, tracers)
+
+		knownContainersMu.Lock()
+		knownContainers = owners
+		knownContainersMu.Unlock()
+
 		// pause for 3 seconds before restarting the loop
 		// prevents constant polling and gives Docker time to change state
 		time.Sleep(3 * time.Second)
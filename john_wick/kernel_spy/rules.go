@@ -0,0 +1,361 @@
+package kernel_spy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"path"
+	"syscall"
+
+	"john_wick/profiles"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// rule maps of single LSM modules
+const (
+	fileRulesMapPath  = "/sys/fs/bpf/maps/map_file_rules"
+	chmodRulesMapPath = "/sys/fs/bpf/maps/map_chmod_rules"
+
+	protectedInodesMapPath = "/sys/fs/bpf/maps/map_protected_inodes"
+	protectedPathsMapPath  = "/sys/fs/bpf/maps/map_protected_paths"
+
+	execInodesMapPath = "/sys/fs/bpf/maps/map_exec_inodes"
+	execRulesMapPath  = "/sys/fs/bpf/maps/map_exec_rules"
+
+	connectRulesMapPath = "/sys/fs/bpf/maps/map_connect_rules"
+
+	ptraceExemptMapPath = "/sys/fs/bpf/maps/map_ptrace_exempt"
+	mountFSTypesMapPath = "/sys/fs/bpf/maps/map_mount_fstypes"
+)
+
+/*
+ * value of a path rule map
+ * the layout has to match struct path_rule in
+ * bpf_modules/include_dir/path_rules.h
+ */
+type pathRule struct {
+	Match     uint32
+	Len       uint32
+	Deny      uint32
+	ProfileID uint32
+	Pattern   [profiles.MaxPatternLen]byte
+}
+
+/*
+ * A pinned map that belongs to a single LSM module.
+ * The module may be started after kernel_spy (or not at all),
+ * so the map is opened on first use and kernel_spy keeps running without it.
+ */
+type moduleMap struct {
+	path   string
+	m      *ebpf.Map
+	warned bool
+}
+
+func (mm *moduleMap) get() *ebpf.Map {
+	if mm.m != nil {
+		return mm.m
+	}
+	m, err := ebpf.LoadPinnedMap(mm.path, &ebpf.LoadPinOptions{})
+	if err != nil {
+		// only complain once, the module is probably not running
+		if !mm.warned {
+			log.Printf("eBPF map %s is not available: %v", mm.path, err)
+			mm.warned = true
+		}
+		return nil
+	}
+	mm.m = m
+	return m
+}
+
+// write the rules into the slots of a path rule map, all other slots are cleared
+func writePathRules(mm *moduleMap, rules []profiles.PathRule) {
+	m := mm.get()
+	if m == nil {
+		return
+	}
+
+	if len(rules) > int(m.MaxEntries()) {
+		log.Printf("%d rules do not fit into %s, only the first %d are used", len(rules), mm.path, m.MaxEntries())
+	}
+
+	for i := uint32(0); i < m.MaxEntries(); i++ {
+		var want pathRule
+		if int(i) < len(rules) {
+			r := rules[i]
+			want = pathRule{
+				Match:     r.Match,
+				Len:       uint32(len(r.Pattern)),
+				Deny:      r.Deny,
+				ProfileID: r.ProfileID,
+			}
+			copy(want.Pattern[:], r.Pattern)
+		}
+
+		// only write slots that changed
+		var current pathRule
+		if err := m.Lookup(i, &current); err == nil && current == want {
+			continue
+		}
+		if err := m.Update(i, want, ebpf.UpdateAny); err != nil {
+			log.Printf("Failed to write rule %d into %s: %v", i, mm.path, err)
+		}
+	}
+}
+
+/*
+ * key of map_protected_inodes
+ * the layout has to match struct protected_inode in
+ * bpf_modules/lsm_rmdir/lsm_rmdir.c
+ */
+type protectedInode struct {
+	Ino uint64
+	Dev uint32
+	_   uint32
+}
+
+/*
+ * Resolve the protected directories of a container to inodes.
+ * /proc/<pid>/root is the root filesystem of the container, so "/etc" is looked up
+ * as /proc/<pid>/root/etc and yields the inode the container's processes see.
+ */
+func resolveProtectedInodes(pid int, dirs []string) []protectedInode {
+	var inodes []protectedInode
+	for _, dir := range dirs {
+		var stat syscall.Stat_t
+		p := path.Join(fmt.Sprintf("/proc/%d/root", pid), dir)
+		if err := syscall.Stat(p, &stat); err != nil {
+			// the directory does not exist in this container
+			if !errors.Is(err, syscall.ENOENT) {
+				log.Printf("Stat failed for %s: %v", p, err)
+			}
+			continue
+		}
+		inodes = append(inodes, protectedInode{
+			Ino: stat.Ino,
+			Dev: kernelDev(uint64(stat.Dev)),
+		})
+	}
+	return inodes
+}
+
+// the kernel stores a device as MKDEV(major, minor) = major << 20 | minor
+func kernelDev(dev uint64) uint32 {
+	return unix.Major(dev)<<20 | unix.Minor(dev)
+}
+
+/*
+ * key of map_exec_inodes
+ * the layout has to match struct exec_inode in
+ * bpf_modules/lsm_exec/lsm_exec.c
+ */
+type execInode struct {
+	Ino       uint64
+	Dev       uint32
+	ProfileID uint32
+}
+
+/*
+ * Resolve the listed executables of a container to inodes, like resolveProtectedInodes.
+ * The inode number is the one of the file, the device the one of the directory it lives in:
+ * for a file on the overlay root filesystem stat reports the device of the underlying layer,
+ * while lsm_exec sees the overlay's device, which only directories report.
+ */
+func resolveExecInodes(pid int, profileID uint32, files []string) []execInode {
+	var inodes []execInode
+	for _, file := range files {
+		var stat, dirStat syscall.Stat_t
+		p := path.Join(fmt.Sprintf("/proc/%d/root", pid), file)
+		if err := syscall.Stat(p, &stat); err != nil {
+			// the executable does not exist in this container
+			if !errors.Is(err, syscall.ENOENT) {
+				log.Printf("Stat failed for %s: %v", p, err)
+			}
+			continue
+		}
+		if err := syscall.Stat(path.Dir(p), &dirStat); err != nil {
+			log.Printf("Stat failed for %s: %v", path.Dir(p), err)
+			continue
+		}
+		inodes = append(inodes, execInode{
+			Ino:       stat.Ino,
+			Dev:       kernelDev(uint64(dirStat.Dev)),
+			ProfileID: profileID,
+		})
+	}
+	return inodes
+}
+
+/*
+ * Bring a set map (map_protected_inodes, map_exec_inodes, map_ptrace_exempt, map_mount_fstypes)
+ * in line with the desired set of keys. The values of these maps are unused.
+ */
+func writeKeySet[K comparable](mm *moduleMap, desired map[K]struct{}) {
+	m := mm.get()
+	if m == nil {
+		return
+	}
+
+	current := make(map[K]struct{})
+	var key K
+	var value uint32
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		current[key] = struct{}{}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Could not read %s: %v", mm.path, err)
+		return
+	}
+
+	for key := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete %+v from %s: %v", key, mm.path, err)
+		}
+	}
+	for key := range desired {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		if err := m.Update(key, uint32(1), ebpf.UpdateAny); err != nil {
+			if errors.Is(err, syscall.E2BIG) {
+				log.Printf("%s is full, %+v is not added", mm.path, key)
+			} else {
+				log.Printf("Failed to add %+v to %s: %v", key, mm.path, err)
+			}
+		}
+	}
+}
+
+/*
+ * key and value of map_connect_rules
+ * the layout has to match struct connect_key, struct connect_port and struct connect_rule in
+ * bpf_modules/lsm_socket_connect/lsm_socket_connect.c
+ */
+type connectKey struct {
+	Prefixlen uint32
+	ProfileID uint32
+	Addr      [16]byte
+}
+
+type connectPort struct {
+	First  uint16
+	Last   uint16
+	Proto  uint8
+	Action uint8
+	_      uint16
+}
+
+type connectRule struct {
+	Ports [profiles.MaxConnectPorts]connectPort
+}
+
+/*
+ * Translate a destination into its trie entry.
+ * IPv4 prefixes become IPv4-mapped IPv6 prefixes (::ffff:0:0/96 + the IPv4 bits),
+ * the prefix length also covers the 32 bits of the profile id.
+ */
+func connectEntry(d profiles.ConnectDestination) (connectKey, connectRule) {
+	key := connectKey{ProfileID: d.ProfileID}
+	bits := d.Prefix.Bits()
+	if d.Prefix.Addr().Is4() {
+		bits += 96
+	}
+	key.Prefixlen = 32 + uint32(bits)
+	key.Addr = netip.AddrFrom16(d.Prefix.Addr().As16()).As16()
+
+	var rule connectRule
+	for i, p := range d.Ports {
+		rule.Ports[i] = connectPort{First: p.First, Last: p.Last, Proto: p.Protocol, Action: p.Action}
+	}
+	return key, rule
+}
+
+// bring map_connect_rules in line with the destinations of all profiles
+func writeConnectRules(mm *moduleMap, destinations []profiles.ConnectDestination) {
+	m := mm.get()
+	if m == nil {
+		return
+	}
+
+	desired := make(map[connectKey]connectRule, len(destinations))
+	for _, d := range destinations {
+		key, rule := connectEntry(d)
+		desired[key] = rule
+	}
+
+	current := make(map[connectKey]connectRule)
+	var key connectKey
+	var rule connectRule
+	iter := m.Iterate()
+	for iter.Next(&key, &rule) {
+		current[key] = rule
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Could not read %s: %v", mm.path, err)
+		return
+	}
+
+	for key := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf("Failed to delete connect rule from %s: %v", mm.path, err)
+		}
+	}
+	for key, rule := range desired {
+		if old, ok := current[key]; ok && old == rule {
+			continue
+		}
+		if err := m.Update(key, rule, ebpf.UpdateAny); err != nil {
+			log.Printf("Failed to write connect rule for profile %d into %s: %v", key.ProfileID, mm.path, err)
+		}
+	}
+}
+
+/*
+ * key of map_ptrace_exempt
+ * the layout has to match struct ptrace_exempt in
+ * bpf_modules/lsm_ptrace/lsm_ptrace.c, which is the same as struct exec_inode
+ */
+type exemptTracer execInode
+
+// resolve the exempted tracers of a container to inodes, the same way as its executables
+func resolvePtraceExempt(pid int, profileID uint32, files []string) []exemptTracer {
+	var exempt []exemptTracer
+	for _, inode := range resolveExecInodes(pid, profileID, files) {
+		exempt = append(exempt, exemptTracer(inode))
+	}
+	return exempt
+}
+
+/*
+ * key of map_mount_fstypes
+ * the layout has to match struct mount_fstype in
+ * bpf_modules/lsm_mount/lsm_mount.c
+ */
+type mountFSType struct {
+	ProfileID uint32
+	FSType    [profiles.MaxFSTypeLen + 1]byte
+}
+
+// the allowed filesystem types of every profile
+func mountAllowlist(cfg *profiles.Config) map[mountFSType]struct{} {
+	allowed := make(map[mountFSType]struct{})
+	for _, p := range cfg.Profiles {
+		for _, fstype := range p.MountAllow {
+			key := mountFSType{ProfileID: p.ID}
+			copy(key.FSType[:], fstype)
+			allowed[key] = struct{}{}
+		}
+	}
+	return allowed
+}
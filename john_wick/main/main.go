@@ -1,21 +1,49 @@
 package main
 
 import (
+	"flag"
 	"john_wick/kernel_spy"
 	"john_wick/spawner"
+	"john_wick/violations"
 	"log"
 	"time"
 )
 
 func main() {
+	/*
+	 * self protection keeps everything outside of john_wick's cgroup from modifying its maps, pins and links
+	 * and from signaling its processes, management tools that need write access are listed in authorized-cgroups
+	 */
+	selfProtect := flag.Bool("self-protect", false, "protect john_wick's bpf objects and processes from the host")
+	authorizedCgroups := flag.String("authorized-cgroups", "", "comma separated cgroup paths of management tools (with -self-protect)")
+	flag.Parse()
+
 	paths := []string{
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_chmod",
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_rmdir",
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_file_permission",
+		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_exec",
+		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_socket_connect",
+		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_ptrace",
+		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_mount",
+		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_kernel",
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/firewall_modules/firewall_container",
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/firewall_modules/firewall_system",
 	}
 
+	if *selfProtect {
+		var args []string
+		if *authorizedCgroups != "" {
+			args = append(args, "-authorized-cgroups", *authorizedCgroups)
+		}
+		go func() {
+			p := "/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/lsm_modules/lsm_self_protect"
+			if err := spawner.Spawn(p, args...); err != nil {
+				log.Printf("error spawning %s: %v", p, err)
+			}
+		}()
+	}
+
 	for _, path := range paths {
 		go func(p string) {
 			if err := spawner.Spawn(p); err != nil {
@@ -32,6 +60,8 @@ func main() {
 	time.Sleep(10 * time.Second)
 	go spawner.Spawn(
 		"/home/furkan/oth/XI/European-honey-buzzard/john_wick/arsenal/userspace_programs/set_ip_range")
+	// store violation events of the LSM programs in the violations table
+	go violations.Collect()
 	kernel_spy.GetContainerCgroupIDs()
 
 	// keep Goroutines alive by blocking main
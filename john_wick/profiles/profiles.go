@@ -0,0 +1,842 @@
+package profiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ids of the LSM hooks, the values have to match the HOOK_ID_* defines in bpf_modules/include_dir/container_policy.h
+const (
+	HookIDChmod          uint32 = 0
+	HookIDRmdir          uint32 = 1
+	HookIDFilePermission uint32 = 2
+	HookIDUnlink         uint32 = 3
+	HookIDRename         uint32 = 4
+	HookIDExec           uint32 = 5
+	HookIDSocketConnect  uint32 = 6
+	HookIDPtrace         uint32 = 7
+	HookIDMount          uint32 = 8
+	HookIDKernelModule   uint32 = 9
+	HookIDBPF            uint32 = 10
+	// not a container hook, only policy_modes switches its mode
+	HookIDSelfProtect uint32 = 11
+)
+
+// bits of a profile's hook mask, each bit enables one LSM hook
+const (
+	HookChmod          uint32 = 1 << HookIDChmod
+	HookRmdir          uint32 = 1 << HookIDRmdir
+	HookFilePermission uint32 = 1 << HookIDFilePermission
+	HookUnlink         uint32 = 1 << HookIDUnlink
+	HookRename         uint32 = 1 << HookIDRename
+	HookExec           uint32 = 1 << HookIDExec
+	HookSocketConnect  uint32 = 1 << HookIDSocketConnect
+	HookPtrace         uint32 = 1 << HookIDPtrace
+	HookMount          uint32 = 1 << HookIDMount
+	HookKernelModule   uint32 = 1 << HookIDKernelModule
+	HookBPF            uint32 = 1 << HookIDBPF
+)
+
+// enforcement modes, the values have to match the MODE_* defines in bpf_modules/include_dir/container_policy.h
+const (
+	ModeEnforce uint32 = 0
+	ModeAudit   uint32 = 1
+	ModeOff     uint32 = 2
+)
+
+// bits of a file rule's deny mask, same values as the kernel's MAY_* access mask
+const (
+	FileExec   uint32 = 0x1
+	FileWrite  uint32 = 0x2
+	FileRead   uint32 = 0x4
+	FileAppend uint32 = 0x8
+)
+
+// kinds of mode changes a chmod rule can deny, the values have to match the CHMOD_DENY_* defines in bpf_modules/include_dir/container_policy.h
+const (
+	ChmodSetID               uint32 = 1 << 0
+	ChmodWorldWritable       uint32 = 1 << 1
+	ChmodStickyRemoval       uint32 = 1 << 2
+	ChmodExecOnWritableMount uint32 = 1 << 3
+	ChmodAny                 uint32 = 1 << 4
+)
+
+// bits of a profile's exec flags, the values have to match the EXEC_* defines in bpf_modules/include_dir/container_policy.h
+const (
+	ExecAllowlist uint32 = 1 << 0
+	ExecDenyUpper uint32 = 1 << 1
+)
+
+// actions of connect rules, the values have to match the CONNECT_* defines in bpf_modules/include_dir/container_policy.h
+const (
+	ConnectAllow uint8 = 1
+	ConnectDeny  uint8 = 2
+)
+
+// port ranges per destination CIDR, see MAX_CONNECT_PORTS in bpf_modules/lsm_socket_connect/lsm_socket_connect.c
+const MaxConnectPorts = 8
+
+// kinds of path rules, the values have to match the RULE_MATCH_* defines in bpf_modules/include_dir/path_rules.h
+const (
+	MatchExact  uint32 = 1
+	MatchPrefix uint32 = 2
+	MatchSuffix uint32 = 3
+)
+
+// limits of the rule maps, see PATH_RULE_LEN and MAX_PATH_RULES in bpf_modules/include_dir/path_rules.h
+const (
+	MaxPatternLen = 64
+	MaxPathRules  = 32
+)
+
+/*
+ * cgroup levels the bpf programs search for a container's cgroup, see MAX_CGROUP_LEVEL, DEFAULT_CGROUP_LEVEL
+ * and SLOT_CGROUP_LEVEL in bpf_modules/include_dir/container_policy.h
+ */
+const (
+	MaxCgroupLevel     uint32 = 32
+	DefaultCgroupLevel uint32 = 16
+	SlotCgroupLevel    uint32 = 31
+)
+
+// longest filesystem type of a mount allowlist, EVENT_FSTYPE_LEN in bpf_modules/include_dir/violation_event.h without the NUL
+const MaxFSTypeLen = 15
+
+// a container can pick its profile directly with this label, e.g. honey-buzzard.profile=build
+const ProfileLabel = "honey-buzzard.profile"
+
+// default location of the profile configuration, relative to the john_wick working directory
+const ConfigPath = "profiles.json"
+
+var hookNames = map[string]uint32{
+	"chmod":           HookChmod,
+	"rmdir":           HookRmdir,
+	"file_permission": HookFilePermission,
+	"unlink":          HookUnlink,
+	"rename":          HookRename,
+	"exec":            HookExec,
+	"socket_connect":  HookSocketConnect,
+	"ptrace":          HookPtrace,
+	"mount":           HookMount,
+	"kernel_module":   HookKernelModule,
+	"bpf":             HookBPF,
+}
+
+// hooks that are not part of a profile, policy_modes can still switch them to audit or off
+var globalHookIDs = map[string]uint32{
+	"self_protect": HookIDSelfProtect,
+}
+
+// HOOK_ID_* -> name, for reports such as violation events
+var hookIDNames = func() map[uint32]string {
+	names := make(map[uint32]string, len(hookNames)+len(globalHookIDs))
+	for name, bit := range hookNames {
+		names[uint32(bits.TrailingZeros32(bit))] = name
+	}
+	for name, id := range globalHookIDs {
+		names[id] = name
+	}
+	return names
+}()
+
+// the name of a HOOK_ID_* value as it is used in profiles, empty for unknown ids
+func HookName(id uint32) string {
+	return hookIDNames[id]
+}
+
+var modeNames = map[string]uint32{
+	"enforce": ModeEnforce,
+	"audit":   ModeAudit,
+	"off":     ModeOff,
+}
+
+var connectActionNames = map[string]uint8{
+	"allow": ConnectAllow,
+	"deny":  ConnectDeny,
+}
+
+// IPPROTO_* numbers of the protocols a connect rule can be limited to
+var protocolNumbers = map[string]uint8{
+	"tcp": 6,
+	"udp": 17,
+}
+
+var chmodChangeNames = map[string]uint32{
+	"setid":                  ChmodSetID,
+	"world_writable":         ChmodWorldWritable,
+	"sticky_removal":         ChmodStickyRemoval,
+	"exec_on_writable_mount": ChmodExecOnWritableMount,
+	"any":                    ChmodAny,
+}
+
+var fileAccessNames = map[string]uint32{
+	"exec":   FileExec,
+	"write":  FileWrite,
+	"read":   FileRead,
+	"append": FileAppend,
+}
+
+/*
+ * A named set of restrictions.
+ * Hooks lists the LSM hooks that apply to containers with this profile,
+ * every other hook lets the container through.
+ */
+type Profile struct {
+	Name  string   `json:"name"`
+	Hooks []string `json:"hooks"`
+	// hook -> enforce, audit or off; hooks in Hooks without an entry here are enforced
+	Modes map[string]string `json:"modes,omitempty"`
+	// files protected from containers with this profile
+	FileRules []FileRule `json:"file_rules,omitempty"`
+	// mode changes denied by the chmod hook, a chmod that matches no rule is allowed
+	ChmodRules []ChmodRule `json:"chmod_rules,omitempty"`
+	/*
+	 * directory trees the rmdir, unlink and rename hooks protect
+	 * an exact path (e.g. "/etc") is resolved to the directory's inode inside every container,
+	 * a pattern (e.g. "/data/*") is matched against the path of the directory an entry is removed from
+	 */
+	ProtectedDirs []string `json:"protected_dirs,omitempty"`
+	// executables the exec hook allows or denies
+	Exec *ExecPolicy `json:"exec,omitempty"`
+	// destinations the socket_connect hook allows or denies
+	Connect *ConnectPolicy `json:"connect,omitempty"`
+	/*
+	 * executables (e.g. "/usr/bin/gdb") the ptrace hook lets trace inside the container
+	 * the paths are resolved to the file's inode inside every container, a process name could be faked
+	 */
+	PtraceExempt []string `json:"ptrace_exempt,omitempty"`
+	/*
+	 * filesystem types (e.g. "tmpfs") the mount hook lets the container mount, every other mount is denied
+	 * "bind", "remount", "move", "propagation" and "umount" allow the operations without a filesystem type
+	 */
+	MountAllow []string `json:"mount_allow,omitempty"`
+
+	// filled in by Load, ids start at 1 (0 means "no profile")
+	ID        uint32 `json:"-"`
+	HookMask  uint32 `json:"-"`
+	AuditMask uint32 `json:"-"`
+	// changes denied by chmod rules without paths
+	ChmodMask uint32 `json:"-"`
+	// exact paths of ProtectedDirs, resolved to inodes by kernel_spy
+	ProtectedInodes []string `json:"-"`
+	// EXEC_* flags of the exec hook
+	ExecFlags uint32 `json:"-"`
+	// exact paths of Exec.Paths, resolved to inodes by kernel_spy
+	ExecInodes []string `json:"-"`
+	// CONNECT_* action for destinations without a matching rule
+	ConnectDefault uint32 `json:"-"`
+	// paths of PtraceExempt, resolved to inodes by kernel_spy
+	PtraceInodes []string `json:"-"`
+}
+
+/*
+ * Controls which executables a container may run.
+ * Mode "allowlist" only lets the executables in Paths run, "denylist" (the default) blocks them.
+ * An exact path (e.g. "/usr/bin/curl") is resolved to the file's inode inside every container,
+ * a pattern (e.g. "/usr/bin/*") is matched against the path of the executable.
+ * Scripts also need their interpreter (e.g. "/bin/sh") on an allowlist.
+ * DenyUpperLayer blocks every file the container wrote itself (the writable layer of its root
+ * filesystem), so binaries dropped at runtime can't run while the image's own binaries can.
+ */
+type ExecPolicy struct {
+	Mode           string   `json:"mode,omitempty"`
+	Paths          []string `json:"paths,omitempty"`
+	DenyUpperLayer bool     `json:"deny_upper_layer,omitempty"`
+}
+
+/*
+ * Denies the mode changes in Deny (setid, world_writable, sticky_removal, exec_on_writable_mount, any).
+ * Without Paths the rule applies everywhere, otherwise only to paths that match one of the
+ * patterns (same syntax as file rules, e.g. "/app/*").
+ */
+type ChmodRule struct {
+	Deny  []string `json:"deny"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+/*
+ * Protects the files that match Pattern against the access types in Deny (exec, write, read, append).
+ * Pattern is matched against the full path inside the container:
+ * "/run/secrets/*" (prefix), "*.pem" (suffix) or "/etc/shadow" (exact path).
+ */
+type FileRule struct {
+	Pattern string   `json:"pattern"`
+	Deny    []string `json:"deny"`
+}
+
+/*
+ * Controls the outgoing connections (connect()) of a container.
+ * Default ("allow" or "deny") applies to destinations no rule matches.
+ */
+type ConnectPolicy struct {
+	Default string        `json:"default,omitempty"`
+	Rules   []ConnectRule `json:"rules,omitempty"`
+}
+
+/*
+ * Allows or denies connections to CIDR (e.g. "10.0.0.0/8", "fd00::/8" or a single address).
+ * Ports is a single port or a range ("8000-8100"), empty means every port.
+ * Protocol is "tcp" or "udp", empty means both.
+ * Only the most specific CIDR of a destination is looked at, rules with the same CIDR are checked in order.
+ */
+type ConnectRule struct {
+	CIDR     string `json:"cidr"`
+	Ports    string `json:"ports,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Action   string `json:"action"`
+}
+
+// a port range of a connect destination (struct connect_port)
+type ConnectPort struct {
+	First    uint16
+	Last     uint16
+	Protocol uint8
+	Action   uint8
+}
+
+// all port ranges of one destination CIDR of a profile (an entry of map_connect_rules)
+type ConnectDestination struct {
+	ProfileID uint32
+	Prefix    netip.Prefix
+	Ports     []ConnectPort
+}
+
+// a rule in the form the bpf programs match on (struct path_rule)
+type PathRule struct {
+	Match   uint32
+	Pattern string
+	Deny    uint32
+	// 0 applies to every profile
+	ProfileID uint32
+}
+
+/*
+ * Assigns a profile to every container that matches all non-empty fields.
+ * Label is either "key" or "key=value", Image and Name are glob patterns (e.g. "golang:*").
+ */
+type Assignment struct {
+	Profile string `json:"profile"`
+	Label   string `json:"label,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+type Config struct {
+	// profile of containers that match no assignment
+	Default string `json:"default"`
+	/*
+	 * hook -> enforce, audit or off for every container at once
+	 * e.g. {"chmod": "audit"} to roll out lsm_chmod without denying anything yet
+	 * the less strict of this mode and the profile's mode applies
+	 */
+	PolicyModes map[string]string `json:"policy_modes,omitempty"`
+	/*
+	 * deepest cgroup level (the root cgroup is level 0) that is searched for the cgroup of a container,
+	 * a task in a sub-cgroup of its container is only matched if the container's cgroup is not deeper
+	 * 0 uses DefaultCgroupLevel
+	 */
+	CgroupLevel uint32 `json:"cgroup_level,omitempty"`
+	// file rules that apply to every profile with the file_permission hook
+	FileRules   []FileRule   `json:"file_rules,omitempty"`
+	Profiles    []Profile    `json:"profiles"`
+	Assignments []Assignment `json:"assignments"`
+
+	byName         map[string]*Profile
+	fileRules      []PathRule
+	chmodRules     []PathRule
+	protectedPaths []PathRule
+	execRules      []PathRule
+	connectRules   []ConnectDestination
+}
+
+// the information about a container that assignments can match on
+type Container struct {
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+/*
+ * built-in profiles, used when no configuration file exists
+ * strict is the default, unlike the hooks before profiles existed it does not deny every chmod
+ * and rmdir: chmod only denies dangerous mode changes, rmdir, unlink and rename only protect
+ * the system directories
+ */
+func Defaults() *Config {
+	cfg := &Config{
+		Default: "strict",
+		Profiles: []Profile{
+			{
+				Name:          "strict",
+				Hooks:         []string{"chmod", "rmdir", "unlink", "rename", "file_permission"},
+				ProtectedDirs: []string{"/etc", "/usr", "/bin", "/sbin", "/lib"},
+				FileRules:     []FileRule{{Pattern: "*confidential", Deny: []string{"write", "exec"}}},
+				ChmodRules: []ChmodRule{
+					{Deny: []string{"setid", "world_writable", "sticky_removal", "exec_on_writable_mount"}},
+				},
+			},
+			{
+				Name:      "build",
+				Hooks:     []string{"file_permission"},
+				FileRules: []FileRule{{Pattern: "*confidential", Deny: []string{"write"}}},
+			},
+			{
+				Name:  "readonly-secrets",
+				Hooks: []string{"file_permission"},
+				FileRules: []FileRule{
+					{Pattern: "*confidential", Deny: []string{"write", "append", "exec"}},
+					{Pattern: "/run/secrets/*", Deny: []string{"write", "append", "exec"}},
+				},
+			},
+		},
+	}
+	if err := cfg.compile(); err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+/*
+ * Read the profile configuration from a JSON file.
+ * If the file does not exist, the built-in profiles are returned.
+ */
+func Load(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return Defaults(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if err := cfg.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &cfg, nil
+}
+
+// translate the names in every profile into the bitmasks the bpf programs check
+func (c *Config) compile() error {
+	c.byName = make(map[string]*Profile, len(c.Profiles))
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		if _, dup := c.byName[p.Name]; dup {
+			return fmt.Errorf("profile %q is defined twice", p.Name)
+		}
+		p.ID = uint32(i + 1)
+
+		p.HookMask = 0
+		for _, h := range p.Hooks {
+			bit, ok := hookNames[h]
+			if !ok {
+				return fmt.Errorf("profile %q: unknown hook %q", p.Name, h)
+			}
+			p.HookMask |= bit
+		}
+
+		p.AuditMask = 0
+		for h, m := range p.Modes {
+			bit, ok := hookNames[h]
+			if !ok {
+				return fmt.Errorf("profile %q: unknown hook %q in modes", p.Name, h)
+			}
+			mode, ok := modeNames[m]
+			if !ok {
+				return fmt.Errorf("profile %q: unknown mode %q for hook %q", p.Name, m, h)
+			}
+			switch mode {
+			case ModeAudit:
+				p.AuditMask |= bit
+			case ModeOff:
+				p.HookMask &^= bit
+			}
+		}
+		// a hook that is off is neither enforced nor audited
+		p.AuditMask &= p.HookMask
+
+		c.byName[p.Name] = p
+	}
+
+	c.fileRules = nil
+	for _, r := range c.FileRules {
+		rule, err := compileFileRule(r, 0)
+		if err != nil {
+			return err
+		}
+		c.fileRules = append(c.fileRules, rule)
+	}
+	for _, p := range c.Profiles {
+		for _, r := range p.FileRules {
+			rule, err := compileFileRule(r, p.ID)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", p.Name, err)
+			}
+			c.fileRules = append(c.fileRules, rule)
+		}
+	}
+	if len(c.fileRules) > MaxPathRules {
+		return fmt.Errorf("%d file rules configured, at most %d are supported", len(c.fileRules), MaxPathRules)
+	}
+
+	c.chmodRules = nil
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.ChmodMask = 0
+		for _, r := range p.ChmodRules {
+			var deny uint32
+			for _, d := range r.Deny {
+				bit, ok := chmodChangeNames[d]
+				if !ok {
+					return fmt.Errorf("profile %q: unknown chmod change %q", p.Name, d)
+				}
+				deny |= bit
+			}
+			if len(r.Paths) == 0 {
+				p.ChmodMask |= deny
+				continue
+			}
+			for _, pattern := range r.Paths {
+				match, text, err := compilePattern(pattern)
+				if err != nil {
+					return fmt.Errorf("profile %q: %w", p.Name, err)
+				}
+				c.chmodRules = append(c.chmodRules, PathRule{Match: match, Pattern: text, Deny: deny, ProfileID: p.ID})
+			}
+		}
+	}
+	if len(c.chmodRules) > MaxPathRules {
+		return fmt.Errorf("%d chmod paths configured, at most %d are supported", len(c.chmodRules), MaxPathRules)
+	}
+
+	c.protectedPaths = nil
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.ProtectedInodes = nil
+		for _, dir := range p.ProtectedDirs {
+			if !strings.Contains(dir, "*") {
+				if !path.IsAbs(dir) {
+					return fmt.Errorf("profile %q: protected directory %q is not an absolute path", p.Name, dir)
+				}
+				p.ProtectedInodes = append(p.ProtectedInodes, path.Clean(dir))
+				continue
+			}
+			match, text, err := compilePattern(dir)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", p.Name, err)
+			}
+			// the deny mask is not used by lsm_rmdir, any match protects
+			c.protectedPaths = append(c.protectedPaths, PathRule{Match: match, Pattern: text, Deny: 1, ProfileID: p.ID})
+		}
+	}
+	if len(c.protectedPaths) > MaxPathRules {
+		return fmt.Errorf("%d protected directory patterns configured, at most %d are supported", len(c.protectedPaths), MaxPathRules)
+	}
+
+	c.execRules = nil
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.ExecFlags = 0
+		p.ExecInodes = nil
+		if p.Exec == nil {
+			continue
+		}
+		switch p.Exec.Mode {
+		case "allowlist":
+			p.ExecFlags |= ExecAllowlist
+		case "", "denylist":
+		default:
+			return fmt.Errorf("profile %q: unknown exec mode %q", p.Name, p.Exec.Mode)
+		}
+		if p.Exec.DenyUpperLayer {
+			p.ExecFlags |= ExecDenyUpper
+		}
+		for _, file := range p.Exec.Paths {
+			if !strings.Contains(file, "*") {
+				if !path.IsAbs(file) {
+					return fmt.Errorf("profile %q: executable %q is not an absolute path", p.Name, file)
+				}
+				p.ExecInodes = append(p.ExecInodes, path.Clean(file))
+				continue
+			}
+			match, text, err := compilePattern(file)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", p.Name, err)
+			}
+			// the deny mask is not used by lsm_exec, any match puts the file on the list
+			c.execRules = append(c.execRules, PathRule{Match: match, Pattern: text, Deny: 1, ProfileID: p.ID})
+		}
+	}
+	if len(c.execRules) > MaxPathRules {
+		return fmt.Errorf("%d executable patterns configured, at most %d are supported", len(c.execRules), MaxPathRules)
+	}
+
+	c.connectRules = nil
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.ConnectDefault = uint32(ConnectAllow)
+		if p.Connect == nil {
+			continue
+		}
+		if p.Connect.Default != "" {
+			action, ok := connectActionNames[p.Connect.Default]
+			if !ok {
+				return fmt.Errorf("profile %q: unknown connect default %q", p.Name, p.Connect.Default)
+			}
+			p.ConnectDefault = uint32(action)
+		}
+		// CIDR -> index in c.connectRules, rules with the same CIDR share one map entry
+		byPrefix := make(map[netip.Prefix]int)
+		for _, r := range p.Connect.Rules {
+			prefix, port, err := compileConnectRule(r)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", p.Name, err)
+			}
+			idx, ok := byPrefix[prefix]
+			if !ok {
+				idx = len(c.connectRules)
+				byPrefix[prefix] = idx
+				c.connectRules = append(c.connectRules, ConnectDestination{ProfileID: p.ID, Prefix: prefix})
+			}
+			dest := &c.connectRules[idx]
+			if len(dest.Ports) == MaxConnectPorts {
+				return fmt.Errorf("profile %q: more than %d connect rules for %s", p.Name, MaxConnectPorts, prefix)
+			}
+			dest.Ports = append(dest.Ports, port)
+		}
+	}
+
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.PtraceInodes = nil
+		for _, file := range p.PtraceExempt {
+			if !path.IsAbs(file) || strings.Contains(file, "*") {
+				return fmt.Errorf("profile %q: ptrace exemption %q is not the absolute path of an executable", p.Name, file)
+			}
+			p.PtraceInodes = append(p.PtraceInodes, path.Clean(file))
+		}
+		for _, fstype := range p.MountAllow {
+			if fstype == "" || len(fstype) > MaxFSTypeLen {
+				return fmt.Errorf("profile %q: filesystem type %q must have 1 to %d characters", p.Name, fstype, MaxFSTypeLen)
+			}
+		}
+	}
+
+	for h, m := range c.PolicyModes {
+		_, isHook := hookNames[h]
+		_, isGlobal := globalHookIDs[h]
+		if !isHook && !isGlobal {
+			return fmt.Errorf("unknown hook %q in policy_modes", h)
+		}
+		if _, ok := modeNames[m]; !ok {
+			return fmt.Errorf("unknown mode %q for hook %q in policy_modes", m, h)
+		}
+	}
+
+	if c.CgroupLevel > MaxCgroupLevel {
+		return fmt.Errorf("cgroup_level %d is deeper than the supported %d", c.CgroupLevel, MaxCgroupLevel)
+	}
+
+	if _, ok := c.byName[c.Default]; !ok {
+		return fmt.Errorf("default profile %q is not defined", c.Default)
+	}
+	for _, a := range c.Assignments {
+		if _, ok := c.byName[a.Profile]; !ok {
+			return fmt.Errorf("assignment uses undefined profile %q", a.Profile)
+		}
+	}
+	return nil
+}
+
+/*
+ * Translate a glob pattern into a path rule:
+ * "prefix*" -> prefix match, "*suffix" -> suffix match, anything else -> exact path.
+ */
+func compilePattern(pattern string) (uint32, string, error) {
+	match, text := MatchExact, pattern
+	switch {
+	case strings.HasSuffix(pattern, "*"):
+		match, text = MatchPrefix, strings.TrimSuffix(pattern, "*")
+	case strings.HasPrefix(pattern, "*"):
+		match, text = MatchSuffix, strings.TrimPrefix(pattern, "*")
+	}
+	if text == "" || strings.Contains(text, "*") {
+		return 0, "", fmt.Errorf("pattern %q: only a single leading or trailing * is supported", pattern)
+	}
+	if len(text) > MaxPatternLen {
+		return 0, "", fmt.Errorf("pattern %q is longer than %d characters", pattern, MaxPatternLen)
+	}
+	return match, text, nil
+}
+
+func compileConnectRule(r ConnectRule) (netip.Prefix, ConnectPort, error) {
+	var port ConnectPort
+
+	prefix, err := netip.ParsePrefix(r.CIDR)
+	if err != nil {
+		// a single address
+		addr, addrErr := netip.ParseAddr(r.CIDR)
+		if addrErr != nil {
+			return netip.Prefix{}, port, fmt.Errorf("connect rule: invalid cidr %q", r.CIDR)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	prefix = prefix.Masked()
+
+	action, ok := connectActionNames[r.Action]
+	if !ok {
+		return netip.Prefix{}, port, fmt.Errorf("connect rule %s: unknown action %q", r.CIDR, r.Action)
+	}
+	port.Action = action
+
+	if r.Protocol != "" {
+		proto, ok := protocolNumbers[r.Protocol]
+		if !ok {
+			return netip.Prefix{}, port, fmt.Errorf("connect rule %s: unknown protocol %q", r.CIDR, r.Protocol)
+		}
+		port.Protocol = proto
+	}
+
+	port.First, port.Last = 0, 65535
+	if r.Ports != "" {
+		first, last, isRange := strings.Cut(r.Ports, "-")
+		if !isRange {
+			last = first
+		}
+		f, err1 := strconv.ParseUint(first, 10, 16)
+		l, err2 := strconv.ParseUint(last, 10, 16)
+		if err1 != nil || err2 != nil || f > l {
+			return netip.Prefix{}, port, fmt.Errorf("connect rule %s: invalid ports %q", r.CIDR, r.Ports)
+		}
+		port.First, port.Last = uint16(f), uint16(l)
+	}
+	return prefix, port, nil
+}
+
+func compileFileRule(r FileRule, profileID uint32) (PathRule, error) {
+	match, text, err := compilePattern(r.Pattern)
+	if err != nil {
+		return PathRule{}, err
+	}
+	rule := PathRule{Match: match, Pattern: text, ProfileID: profileID}
+	for _, a := range r.Deny {
+		bit, ok := fileAccessNames[a]
+		if !ok {
+			return PathRule{}, fmt.Errorf("pattern %q: unknown file access %q", r.Pattern, a)
+		}
+		rule.Deny |= bit
+	}
+	return rule, nil
+}
+
+// every file rule of the configuration, for map_file_rules
+func (c *Config) CompiledFileRules() []PathRule {
+	return c.fileRules
+}
+
+// every chmod rule that is scoped to paths, for map_chmod_rules
+func (c *Config) CompiledChmodRules() []PathRule {
+	return c.chmodRules
+}
+
+// every protected directory pattern, for map_protected_paths
+func (c *Config) CompiledProtectedPaths() []PathRule {
+	return c.protectedPaths
+}
+
+// every executable pattern, for map_exec_rules
+func (c *Config) CompiledExecRules() []PathRule {
+	return c.execRules
+}
+
+// every destination CIDR of every profile, for map_connect_rules
+func (c *Config) CompiledConnectRules() []ConnectDestination {
+	return c.connectRules
+}
+
+/*
+ * Return the mode of every hook for all containers (hook id -> mode).
+ * Hooks without an entry in policy_modes are enforced.
+ */
+func (c *Config) HookModes() map[uint32]uint32 {
+	modes := make(map[uint32]uint32, len(hookNames))
+	for h, bit := range hookNames {
+		mode := ModeEnforce
+		if m, ok := c.PolicyModes[h]; ok {
+			mode = modeNames[m]
+		}
+		modes[uint32(bits.TrailingZeros32(bit))] = mode
+	}
+	for h, id := range globalHookIDs {
+		mode := ModeEnforce
+		if m, ok := c.PolicyModes[h]; ok {
+			mode = modeNames[m]
+		}
+		modes[id] = mode
+	}
+	return modes
+}
+
+// the deepest cgroup level that is searched for the cgroup of a container
+func (c *Config) MaxCgroupLevel() uint32 {
+	if c.CgroupLevel == 0 {
+		return DefaultCgroupLevel
+	}
+	return c.CgroupLevel
+}
+
+/*
+ * Pick the profile of a container:
+ * 1. the honey-buzzard.profile label
+ * 2. the first assignment that matches
+ * 3. the default profile
+ */
+func (c *Config) Resolve(ct Container) *Profile {
+	if name, ok := ct.Labels[ProfileLabel]; ok {
+		if p, ok := c.byName[name]; ok {
+			return p
+		}
+	}
+	for _, a := range c.Assignments {
+		if a.matches(ct) {
+			return c.byName[a.Profile]
+		}
+	}
+	return c.byName[c.Default]
+}
+
+func (a Assignment) matches(ct Container) bool {
+	// an assignment without any condition would match everything, that's what Default is for
+	if a.Label == "" && a.Image == "" && a.Name == "" {
+		return false
+	}
+	if a.Label != "" {
+		key, want, hasValue := strings.Cut(a.Label, "=")
+		got, ok := ct.Labels[key]
+		if !ok || (hasValue && got != want) {
+			return false
+		}
+	}
+	if a.Image != "" && !glob(a.Image, ct.Image) {
+		return false
+	}
+	if a.Name != "" && !glob(a.Name, ct.Name) {
+		return false
+	}
+	return true
+}
+
+func glob(pattern, s string) bool {
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
@@ -6,8 +6,8 @@ import (
 	"os/exec"
 )
 
-func Spawn(path string) error {
-	cmd := exec.Command(path)
+func Spawn(path string, args ...string) error {
+	cmd := exec.Command(path, args...)
 
 	// Pass through stdin, stdout, stderr
 	cmd.Stdin = os.Stdin
@@ -0,0 +1,247 @@
+package violations
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"john_wick/kernel_spy"
+	"john_wick/profiles"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"golang.org/x/sys/unix"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	ringBufPath = "/sys/fs/bpf/maps/map_violation_events"
+	dbPath      = "../manager/data/violations.db"
+	// pause before the ring buffer is opened again, the cadence of kernel_spy's passes
+	retryInterval = 3 * time.Second
+)
+
+// names of the DECISION_* values in bpf_modules/include_dir/violation_event.h
+var decisionNames = map[uint32]string{
+	0: "deny",
+	// audit mode: allowed, but would have been denied
+	1: "audit",
+}
+
+/*
+ * one record of the ring buffer
+ * the layout has to match struct violation_event in
+ * bpf_modules/include_dir/violation_event.h
+ */
+type violationEvent struct {
+	TimestampNs uint64
+	CgroupID    uint64
+	Pid         uint32
+	Tgid        uint32
+	UID         uint32
+	Hook        uint32
+	Decision    uint32
+	Mode        uint32
+	Comm        [16]byte
+	Path        [256]byte
+	Source      [256]byte
+	FSType      [16]byte
+}
+
+func openViolationsDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening violations.db: %w", err)
+	}
+
+	createTable := `
+	CREATE TABLE IF NOT EXISTS violations (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_time_nano INTEGER,
+		hook            TEXT,
+		decision        TEXT,
+		pid             INTEGER,
+		tgid            INTEGER,
+		uid             INTEGER,
+		comm            TEXT,
+		cgroup_id       INTEGER,
+		container_id    TEXT,
+		container_name  TEXT,
+		path            TEXT,
+		mode            INTEGER,
+		exe             TEXT,
+		source          TEXT,
+		fstype          TEXT
+	);`
+	if _, err := db.Exec(createTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating violations table: %w", err)
+	}
+	// tables created before these columns existed
+	for _, column := range []string{"exe", "source", "fstype"} {
+		if _, err := db.Exec("ALTER TABLE violations ADD COLUMN " + column + " TEXT;"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Printf("Warning: could not add %s column: %v", column, err)
+		}
+	}
+
+	// same reason as for filtered_logs: other processes read this database while it is written
+	if _, err := db.Exec("PRAGMA journal_mode = WAL;"); err != nil {
+		log.Printf("Warning: could not enable WAL mode: %v", err)
+	}
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000;"); err != nil {
+		log.Printf("Warning: could not set busy_timeout: %v", err)
+	}
+	return db, nil
+}
+
+/*
+ * the bpf programs stamp events with the time since boot (bpf_ktime_get_boot_ns),
+ * convert it to wall clock time by comparing against the current boot time
+ */
+func bootToWallClock(bootNs uint64) time.Time {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return time.Now()
+	}
+	age := time.Duration(ts.Nano() - int64(bootNs))
+	return time.Now().Add(-age)
+}
+
+/*
+ * the executable of the process that caused the event
+ * comm can be changed by the process itself, the exe link can't
+ * empty if the process already exited
+ */
+func processExe(tgid uint32) string {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", tgid))
+	if err != nil {
+		return ""
+	}
+	return exe
+}
+
+// convert a NUL terminated C string into a Go string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+/*
+ * Read violation events from the ring buffer the LSM programs share,
+ * enrich them with container id and name and store them in the violations table.
+ * The ring buffer only exists once an LSM module is loaded, which can be after john_wick
+ * started, so it is opened again every few seconds until it is there, and again whenever
+ * reading from it or opening the database fails.
+ * Blocks forever, run it as a goroutine.
+ */
+func Collect() {
+	missing := false
+	for {
+		err := collect()
+		if errors.Is(err, os.ErrNotExist) {
+			// no LSM module is running yet, only complain once
+			if !missing {
+				log.Printf("Ring buffer %s is not available yet, waiting for it: %v", ringBufPath, err)
+				missing = true
+			}
+		} else {
+			log.Printf("Collecting violations failed, retrying: %v", err)
+			missing = false
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// read and store events until something fails
+func collect() error {
+	ringBufMap, err := ebpf.LoadPinnedMap(ringBufPath, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("opening pinned ring buffer: %w", err)
+	}
+	defer ringBufMap.Close()
+
+	reader, err := ringbuf.NewReader(ringBufMap)
+	if err != nil {
+		return fmt.Errorf("creating ring buffer reader: %w", err)
+	}
+	defer reader.Close()
+
+	db, err := openViolationsDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	insertStmt := `
+		INSERT INTO violations (
+			event_time_nano,
+			hook,
+			decision,
+			pid,
+			tgid,
+			uid,
+			comm,
+			cgroup_id,
+			container_id,
+			container_name,
+			path,
+			mode,
+			exe,
+			source,
+			fstype
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("reading ring buffer: %w", err)
+		}
+
+		var event violationEvent
+		if err := binary.Read(bytes.NewReader(record.RawSample), binary.NativeEndian, &event); err != nil {
+			log.Printf("Error decoding violation event: %v", err)
+			continue
+		}
+
+		// the cgroup id is the key kernel_spy wrote for the container
+		container, _ := kernel_spy.LookupContainer(event.CgroupID)
+
+		hook := profiles.HookName(event.Hook)
+		decision := decisionNames[event.Decision]
+		path := cString(event.Path[:])
+		comm := cString(event.Comm[:])
+		exe := processExe(event.Tgid)
+
+		_, err = db.Exec(insertStmt,
+			bootToWallClock(event.TimestampNs).UnixNano(),
+			hook,
+			decision,
+			event.Pid,
+			event.Tgid,
+			event.UID,
+			comm,
+			int64(event.CgroupID),
+			container.ID,
+			container.Name,
+			path,
+			event.Mode,
+			exe,
+			cString(event.Source[:]),
+			cString(event.FSType[:]),
+		)
+		if err != nil {
+			log.Printf("Error inserting violation: %v", err)
+			continue
+		}
+		log.Printf("Violation: hook=%s, decision=%s, container=%s, comm=%s, exe=%s, pid=%d, path=%s",
+			hook, decision, container.Name, comm, exe, event.Tgid, path)
+	}
+}
@@ -1,11 +1,14 @@
 package filtered_logs
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
+	"github.com/docker/docker/client"
 	"github.com/vishvananda/netlink"
 	_ "modernc.org/sqlite"
 )
@@ -22,11 +25,16 @@ func Spawn_filtered_logs() error {
 	CREATE TABLE IF NOT EXISTS filtered_logs (
 		container_id TEXT PRIMARY KEY,
 		action       TEXT,
-		veth         TEXT
+		veth         TEXT,
+		ips          TEXT
 	);`
 	if _, err := db.Exec(createTable); err != nil {
 		return fmt.Errorf("creating filtered_logs table: %w", err)
 	}
+	// tables created before the ips column existed
+	if _, err := db.Exec("ALTER TABLE filtered_logs ADD COLUMN ips TEXT;"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Printf("Warning: could not add ips column: %v", err)
+	}
 
 	/*
 	 * Write-Ahead Logging (WAL)
@@ -233,4 +241,73 @@ func Filter() {
 				t.cid[:12], t.oldCSV, t.newCSV)
 		}
 	}
+
+	updateIPs(filteredDB)
+}
+
+/*
+ * Record the current addresses of every container in the ips column (comma separated,
+ * IPv4 and IPv6 of every network). A container that restarts usually gets new addresses,
+ * so they are read from the inspect data on every pass. The firewall resolves container
+ * names and labels in its segment rules to these addresses. Destroyed containers are skipped,
+ * inspecting them would only fail.
+ */
+func updateIPs(filteredDB *sql.DB) {
+	rows, err := filteredDB.Query(`SELECT container_id, COALESCE(ips, '') FROM filtered_logs WHERE action != 'destroy'`)
+	if err != nil {
+		log.Printf("Error fetching containers for ips: %v", err)
+		return
+	}
+	current := make(map[string]string)
+	for rows.Next() {
+		var cid, ips string
+		if err := rows.Scan(&cid, &ips); err != nil {
+			log.Printf("Ips scan error: %v", err)
+			continue
+		}
+		current[cid] = ips
+	}
+	rows.Close()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		log.Printf("Docker client error: %v", err)
+		return
+	}
+	defer cli.Close()
+	cli.NegotiateAPIVersion(context.Background())
+
+	for cid, old := range current {
+		inspect, err := cli.ContainerInspect(context.Background(), cid)
+		if err != nil {
+			log.Printf("Error inspecting %s: %v", cid[:12], err)
+			continue
+		}
+		var ips []string
+		if inspect.NetworkSettings != nil {
+			for _, network := range inspect.NetworkSettings.Networks {
+				if network == nil {
+					continue
+				}
+				for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+					if ip != "" {
+						ips = append(ips, ip)
+					}
+				}
+			}
+		}
+		// the networks come from a map, keep the column stable
+		sort.Strings(ips)
+		newIPs := strings.Join(ips, ",")
+		if newIPs == old {
+			continue
+		}
+		if _, err := filteredDB.Exec(
+			`UPDATE filtered_logs SET ips = ? WHERE container_id = ?`, newIPs, cid,
+		); err != nil {
+			log.Printf("Error updating ips of %s: %v", cid[:12], err)
+		} else {
+			fmt.Printf("Updated ips of %s: old=[%s], new=[%s]\n", cid[:12], old, newIPs)
+		}
+	}
 }